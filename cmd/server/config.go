@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"speedtest/internal/handlers"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix namespaces the environment variables that override settings, e.g. SPEEDTEST_DATA_DIR
+// for -data-dir
+const envPrefix = "SPEEDTEST_"
+
+// serverConfig is every setting of the server. Each one can come from the config file, the
+// environment or a flag, in increasing order of precedence. Keys mirror the flag names.
+type serverConfig struct {
+	Addr     string `yaml:"addr"`
+	Unix     string `yaml:"unix"` // Socket path; replaces Addr when set
+	TLSCert  string `yaml:"tls_cert"`
+	TLSKey   string `yaml:"tls_key"`
+	H2C      bool   `yaml:"h2c"`
+	Pprof    bool   `yaml:"pprof"`
+	GRPCAddr string `yaml:"grpc_addr"` // gRPC listener; disabled when empty
+	// OTLPEndpoint is the OTLP/HTTP collector URL that request traces are sent to; tracing is off
+	// when empty
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+
+	handlers.Config `yaml:",inline"`
+}
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		Addr:   ":8080",
+		Config: handlers.DefaultConfig(),
+	}
+}
+
+// loadConfigFile fills cfg from a YAML file. JSON is valid YAML, so JSON files work too. Unknown
+// keys are rejected so typos don't go unnoticed.
+func loadConfigFile(path string, cfg *serverConfig) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) { // An empty file changes nothing
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyOverrides layers the environment and then the command line over file values. Flags are
+// bound to cfg, so loading the file overwrote any that were given; they are set again here.
+func applyOverrides(fs *flag.FlagSet, setOnCommandLine map[string]string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := setOnCommandLine[f.Name]; ok || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for name, value := range setOnCommandLine {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable that overrides the flag of the given name
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// reloadIPLists re-reads allow_cidrs and deny_cidrs for SIGHUP, with the same precedence as at
+// startup: the config file, then the environment, then the command line
+func reloadIPLists(configPath string, setOnCommandLine map[string]string) (allow, deny string, err error) {
+	next := defaultServerConfig()
+	if configPath != "" {
+		if err := loadConfigFile(configPath, &next); err != nil {
+			return "", "", err
+		}
+	}
+	return overriddenValue("allow-cidrs", next.AllowCIDRs, setOnCommandLine),
+		overriddenValue("deny-cidrs", next.DenyCIDRs, setOnCommandLine), nil
+}
+
+// overriddenValue returns the value of a setting after the environment and command line are
+// applied over value from the file
+func overriddenValue(flagName, value string, setOnCommandLine map[string]string) string {
+	if v, ok := setOnCommandLine[flagName]; ok {
+		return v
+	}
+	if v, ok := os.LookupEnv(envName(flagName)); ok {
+		return v
+	}
+	return value
+}
+
+// validate reports the first setting that is out of range
+func (c serverConfig) validate() error {
+	if c.Addr == "" {
+		return errors.New("addr must not be empty")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be given together")
+	}
+	if c.OTLPEndpoint != "" {
+		if _, err := parseOTLPEndpoint(c.OTLPEndpoint); err != nil {
+			return fmt.Errorf("otlp_endpoint: %w", err)
+		}
+	}
+	return c.Config.Validate()
+}
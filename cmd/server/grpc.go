@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"speedtest/internal/handlers"
+	"speedtest/internal/rpcpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcChunkBytes is the most data one DownloadChunk carries, well under gRPC's 4 MB default
+// message limit
+const grpcChunkBytes = 1024 * 1024
+
+// grpcService implements the SpeedTest gRPC service. Every call is a request to the REST API made
+// in-process, so both share validation, rate limiting and session state, and errors carry the same
+// codes, as "CODE: message". The REST handlers see the gRPC client's address.
+type grpcService struct {
+	rpcpb.UnimplementedSpeedTestServer
+	api http.Handler
+}
+
+// newGRPCServer returns a gRPC server with the SpeedTest service registered in front of api
+func newGRPCServer(api http.Handler) *grpc.Server {
+	srv := grpc.NewServer()
+	rpcpb.RegisterSpeedTestServer(srv, &grpcService{api: api})
+	return srv
+}
+
+func (s *grpcService) Init(ctx context.Context, in *rpcpb.InitRequest) (*rpcpb.InitResponse, error) {
+	req := handlers.DownloadInitRequest{
+		SizeMB:       int(in.SizeMb),
+		DurationSec:  int(in.DurationSec),
+		Tags:         in.Tags,
+		DryRun:       in.DryRun,
+		Compressible: in.Compressible,
+		Seed:         in.Seed,
+		Generation:   in.Generation,
+	}
+	var header http.Header
+	if in.IdempotencyKey != "" {
+		header = http.Header{handlers.IdempotencyKeyHeader: {in.IdempotencyKey}}
+	}
+	var resp handlers.DownloadInitResponse
+	if err := s.callJSON(ctx, http.MethodPost, "/download/init", req, header, &resp); err != nil {
+		return nil, err
+	}
+	out := &rpcpb.InitResponse{
+		SessionId:              resp.SessionID,
+		Size:                   resp.Size,
+		HashAlgorithm:          resp.HashAlgorithm,
+		ExpectedHash:           resp.ExpectedHash,
+		DurationSec:            int32(resp.DurationSec),
+		DryRun:                 resp.DryRun,
+		CompressibleHash:       resp.CompressibleHash,
+		Generation:             resp.Generation,
+		RecommendedConnections: int32(resp.RecommendedConnections),
+	}
+	if resp.ExpiresAt != nil {
+		out.ExpiresAt = resp.ExpiresAt.Format(time.RFC3339)
+	}
+	return out, nil
+}
+
+// Download streams the file as one GET /download/data, so the whole stream is timed and recorded
+// once, like an HTTP download
+func (s *grpcService) Download(in *rpcpb.DownloadRequest, stream grpc.ServerStreamingServer[rpcpb.DownloadChunk]) error {
+	var header http.Header
+	if in.Length > 0 {
+		if in.Offset < 0 {
+			return status.Errorf(codes.InvalidArgument, "%s: offset must not be negative", handlers.CodeInvalidParameter)
+		}
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", in.Offset, in.Offset+in.Length-1)}}
+	} else if in.Offset != 0 {
+		return status.Errorf(codes.InvalidArgument, "%s: offset needs a length", handlers.CodeInvalidParameter)
+	}
+	req, err := s.newRequest(stream.Context(), http.MethodGet, "/download/data?"+url.Values{"session_id": {in.SessionId}}.Encode(), nil, header)
+	if err != nil {
+		return err
+	}
+	sw := &grpcStreamWriter{header: make(http.Header), stream: stream}
+	s.api.ServeHTTP(sw, req)
+	if sw.status >= http.StatusBadRequest {
+		return grpcError(sw.status, &sw.errBody)
+	}
+	return sw.err
+}
+
+func (s *grpcService) Verify(ctx context.Context, in *rpcpb.VerifyRequest) (*rpcpb.VerifyResponse, error) {
+	req := handlers.DownloadVerifyRequest{
+		SessionID:      in.SessionId,
+		ComputedHash:   in.ComputedHash,
+		ComputedHashes: in.ComputedHashes,
+		Keep:           in.Keep,
+		VerifyBytes:    in.VerifyBytes,
+		ReceivedBytes:  in.ReceivedBytes,
+	}
+	var resp handlers.DownloadVerifyResponse
+	if err := s.callJSON(ctx, http.MethodPost, "/download/verify", req, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &rpcpb.VerifyResponse{Status: resp.Status, Results: resp.Results, BytesHashed: resp.BytesHashed}, nil
+}
+
+func (s *grpcService) Speed(ctx context.Context, in *rpcpb.SpeedRequest) (*rpcpb.SpeedResponse, error) {
+	query := url.Values{"session_id": {in.SessionId}}
+	if in.Units != "" {
+		query.Set("units", in.Units)
+	}
+	var resp handlers.SpeedResponse
+	if err := s.callJSON(ctx, http.MethodGet, "/download/speed?"+query.Encode(), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &rpcpb.SpeedResponse{
+		SessionId:         resp.SessionID,
+		DownloadSpeedMbps: resp.DownloadSpeedMbps,
+		DownloadSpeed:     resp.DownloadSpeed,
+		Unit:              resp.Unit,
+		Status:            resp.Status,
+		BytesTransferred:  resp.BytesTransferred,
+		Proto:             resp.Proto,
+		CompressionRatio:  resp.CompressionRatio,
+		Tags:              resp.Tags,
+		Hostname:          resp.Hostname,
+		Unreliable:        resp.Unreliable,
+		TtfbMs:            resp.TTFBMs,
+	}, nil
+}
+
+// callJSON makes a request with an optional JSON body and decodes the JSON response into reply
+func (s *grpcService) callJSON(ctx context.Context, method, target string, body any, header http.Header, reply any) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Set("Content-Type", "application/json")
+	}
+	req, err := s.newRequest(ctx, method, target, &buf, header)
+	if err != nil {
+		return err
+	}
+	rec := &grpcRecorder{header: make(http.Header)}
+	s.api.ServeHTTP(rec, req)
+	if rec.status >= http.StatusBadRequest {
+		return grpcError(rec.status, &rec.body)
+	}
+	if err := json.NewDecoder(&rec.body).Decode(reply); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// newRequest builds a REST request carrying the call's context and the client's address
+func (s *grpcService) newRequest(ctx context.Context, method, target string, body io.Reader, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Proto = "gRPC"
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+	}
+	return req, nil
+}
+
+// grpcError turns an error response of the REST API into a gRPC status
+func grpcError(httpStatus int, body *bytes.Buffer) error {
+	var e handlers.ErrorResponse
+	if err := json.NewDecoder(body).Decode(&e); err != nil || e.Code == "" {
+		// Not one of ours, e.g. 416 from a range outside the file
+		e.Code = handlers.CodeBadRequest
+		if httpStatus >= http.StatusInternalServerError {
+			e.Code = handlers.CodeInternal
+		}
+		e.Error = http.StatusText(httpStatus)
+	}
+	return status.Errorf(grpcCode(httpStatus), "%s: %s", e.Code, e.Error)
+}
+
+// grpcCode maps an HTTP error status to the closest gRPC code
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusRequestedRangeNotSatisfiable:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict, http.StatusGone:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case handlers.StatusClientClosedRequest:
+		return codes.Canceled
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	if httpStatus >= http.StatusInternalServerError {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// grpcRecorder is the http.ResponseWriter unary calls are served into, keeping the response in
+// memory
+type grpcRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *grpcRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *grpcRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+}
+
+func (rr *grpcRecorder) Write(p []byte) (int, error) {
+	rr.WriteHeader(http.StatusOK)
+	return rr.body.Write(p)
+}
+
+// grpcStreamWriter is the http.ResponseWriter a Download is served into. The body goes straight
+// out as DownloadChunks while the handler times it; an error response is kept for the status.
+type grpcStreamWriter struct {
+	header  http.Header
+	status  int
+	stream  grpc.ServerStreamingServer[rpcpb.DownloadChunk]
+	errBody bytes.Buffer
+	err     error // First failed Send; later writes fail with it too
+}
+
+func (sw *grpcStreamWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *grpcStreamWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+}
+
+func (sw *grpcStreamWriter) Write(p []byte) (int, error) {
+	sw.WriteHeader(http.StatusOK)
+	if sw.status >= http.StatusBadRequest {
+		return sw.errBody.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), grpcChunkBytes)
+		if err := sw.send(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom sends src in full-sized chunks, rather than in the 32 KB pieces io.Copy would write
+func (sw *grpcStreamWriter) ReadFrom(src io.Reader) (int64, error) {
+	sw.WriteHeader(http.StatusOK)
+	if sw.status >= http.StatusBadRequest {
+		return io.Copy(&sw.errBody, src)
+	}
+	buf := make([]byte, grpcChunkBytes)
+	var total int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if sendErr := sw.send(buf[:n]); sendErr != nil {
+				return total, sendErr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (sw *grpcStreamWriter) send(p []byte) error {
+	if sw.err == nil {
+		sw.err = sw.stream.Send(&rpcpb.DownloadChunk{Data: p})
+	}
+	return sw.err
+}
+
+// SetWriteDeadline accepts the transfer deadlines the handlers set; the stream is bounded by its
+// context instead
+func (sw *grpcStreamWriter) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// Flush is a no-op: every chunk is sent as soon as it is written
+func (sw *grpcStreamWriter) Flush() {}
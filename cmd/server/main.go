@@ -1,34 +1,314 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"speedtest/internal/handlers"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 )
 
 func main() {
-	downloadHandler := handlers.NewDownloadHandler()
+	configPath := flag.String("config", "", "YAML or JSON file with settings; environment variables and flags override it")
+	selfTest := flag.Bool("selftest", false, "Download and verify every allowed size over loopback, print timings and exit")
 
+	cfg := defaultServerConfig()
+	flag.StringVar(&cfg.Addr, "addr", cfg.Addr, "Address to listen on")
+	flag.StringVar(&cfg.Unix, "unix", cfg.Unix, "Listen on this Unix socket path instead of -addr")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "TLS certificate file; enables HTTPS (and HTTP/2) together with -tls-key")
+	flag.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "TLS private key file")
+	flag.BoolVar(&cfg.H2C, "h2c", cfg.H2C, "Accept HTTP/2 over plaintext (h2c) in addition to HTTP/1.1")
+	flag.StringVar(&cfg.GRPCAddr, "grpc-addr", cfg.GRPCAddr, "Also serve the gRPC interface (SpeedTest.Init/Download/Verify/Speed) on this address (optional)")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", cfg.OTLPEndpoint, "Send OpenTelemetry traces of requests to this OTLP/HTTP collector URL, e.g. http://localhost:4318 (optional)")
+	flag.BoolVar(&cfg.Pprof, "pprof", cfg.Pprof, "Mount net/http/pprof handlers under /debug/pprof/ (do not expose publicly)")
+	flag.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "Directory for generated test files; separate several with commas to spread files across disks")
+	flag.IntVar(&cfg.PoolSize, "pool", cfg.PoolSize, "Pre-generated files to keep ready per allowed size (0 disables the pool)")
+	flag.BoolVar(&cfg.ShareFiles, "share-files", cfg.ShareFiles, "Back all sessions of the same size with one shared file")
+	flag.IntVar(&cfg.SizeJitterBytes, "size-jitter-bytes", cfg.SizeJitterBytes, "Pad each session's file by a random number of bytes up to this many, defeating caches (0 disables)")
+	flag.BoolVar(&cfg.CoalesceInits, "coalesce-inits", cfg.CoalesceInits, "Share one generation between concurrent inits of the same size")
+	flag.BoolVar(&cfg.Diskless, "diskless", cfg.Diskless, "Stream downloads from crypto/rand instead of generating files")
+	flag.IntVar(&cfg.GenerateBufferKB, "gen-buffer-kb", cfg.GenerateBufferKB, "Buffer size used to generate random test data, in KB")
+	flag.BoolVar(&cfg.FsyncFiles, "fsync-files", cfg.FsyncFiles, "Flush each generated file to disk before handing out its session")
+	flag.BoolVar(&cfg.DirectIO, "direct-io", cfg.DirectIO, "Write generated files with O_DIRECT, bypassing the page cache (Linux only)")
+	flag.IntVar(&cfg.HashBufferKB, "hash-buffer-kb", cfg.HashBufferKB, "Buffer size used to read files back from disk for hashing, in KB")
+	flag.DurationVar(&cfg.MaxResponseDelay, "max-delay", cfg.MaxResponseDelay, "Maximum simulated delay accepted via delay_ms on /ping and /download/init (0 disables)")
+	flag.DurationVar(&cfg.SessionTTL, "session-ttl", cfg.SessionTTL, "How long a session stays usable after init")
+	flag.IntVar(&cfg.MaxResults, "max-results", cfg.MaxResults, "Verification results kept in memory for /results and /summary (0 disables the history)")
+	flag.DurationVar(&cfg.ResultMaxAge, "result-max-age", cfg.ResultMaxAge, "Drop results older than this (0 keeps them until -max-results is reached)")
+	flag.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "How long an Idempotency-Key on /download/init is remembered")
+	flag.DurationVar(&cfg.RateLimitPerMB, "rate-limit-per-mb", cfg.RateLimitPerMB, "Rate limit cost of each MB requested at init (0 disables rate limiting)")
+	flag.DurationVar(&cfg.RateLimitBurst, "rate-limit-burst", cfg.RateLimitBurst, "How far ahead of its rate limit allowance a client may run")
+	flag.StringVar(&cfg.RateLimitBypassToken, "rate-limit-bypass-token", cfg.RateLimitBypassToken, "Token exempting requests that send it in X-Bypass-Token from the rate limit (prefer SPEEDTEST_RATE_LIMIT_BYPASS_TOKEN; empty disables)")
+	flag.IntVar(&cfg.MaxGenerations, "max-generations", cfg.MaxGenerations, "Test files generated at once; further inits queue (0 removes the limit)")
+	flag.DurationVar(&cfg.GenerationWait, "generation-wait", cfg.GenerationWait, "How long an init queues for a generation slot before getting 503")
+	flag.IntVar(&cfg.MaxHashers, "max-hashers", cfg.MaxHashers, "Files read back and hashed at once for verification and block hashes; further requests queue (0 removes the limit)")
+	flag.DurationVar(&cfg.HashWait, "hash-wait", cfg.HashWait, "How long a request queues for a hashing slot before getting 503")
+	flag.Float64Var(&cfg.MaxLoadAverage, "max-load", cfg.MaxLoadAverage, "1-minute load average above which inits get 503 (Linux only; 0 disables)")
+	flag.IntVar(&cfg.MaxSessions, "max-sessions", cfg.MaxSessions, "Active sessions allowed before inits get 503 (0 removes the cap)")
+	flag.IntVar(&cfg.MaxInFlight, "max-in-flight", cfg.MaxInFlight, "HTTP requests served at once before further ones get 503; /healthz is exempt (0 removes the cap)")
+	flag.IntVar(&cfg.MaxConnections, "max-connections", cfg.MaxConnections, "Parallel downloads allowed per session")
+	flag.IntVar(&cfg.MaxDownloadsPerSession, "max-downloads-per-session", cfg.MaxDownloadsPerSession, "Downloads a session serves in total before answering 410, counting each Range request (0 for unlimited)")
+	flag.Float64Var(&cfg.MinBandwidthMbps, "min-bandwidth-mbps", cfg.MinBandwidthMbps, "Slowest download rate tolerated before a transfer is cut off (0 disables)")
+	flag.DurationVar(&cfg.MaxTransferDuration, "max-transfer-duration", cfg.MaxTransferDuration, "Longest a single download may run before it is cut off; overrides the per-size -min-bandwidth-mbps deadline only where that is shorter (0 disables)")
+	flag.IntVar(&cfg.MinReliableMB, "min-reliable-mb", cfg.MinReliableMB, "Downloads smaller than this are flagged unreliable in speeds and results (0 disables)")
+	flag.Float64Var(&cfg.MaxTotalMbps, "max-total-mbps", cfg.MaxTotalMbps, "Combined rate cap of all download responses, shared between them (0 disables)")
+	flag.IntVar(&cfg.MaxUploadMB, "max-upload-mb", cfg.MaxUploadMB, "Largest upload body accepted, in MB")
+	flag.StringVar(&cfg.GeoIPDB, "geoip-db", cfg.GeoIPDB, "MaxMind GeoLite2 City database for adding country/city to results (optional)")
+	flag.StringVar(&cfg.FixtureDir, "fixture-dir", cfg.FixtureDir, "Directory of named files served as is by /download/fixture (optional)")
+	flag.BoolVar(&cfg.ReverseDNS, "reverse-dns", cfg.ReverseDNS, "Add the client's reverse DNS hostname to results (looked up in the background and cached)")
+	flag.StringVar(&cfg.AllowCIDRs, "allow-cidrs", cfg.AllowCIDRs, "Comma-separated CIDRs of the only clients allowed; others get 403 (reloaded on SIGHUP; empty allows all)")
+	flag.StringVar(&cfg.DenyCIDRs, "deny-cidrs", cfg.DenyCIDRs, "Comma-separated CIDRs of clients refused with 403, even if allowed (reloaded on SIGHUP)")
+	flag.IntVar(&cfg.TrustedProxies, "trusted-proxies", cfg.TrustedProxies, "Reverse proxies in front of the server; the client IP is taken this many X-Forwarded-For entries from the right (0 ignores the header)")
+	flag.BoolVar(&cfg.Debug, "debug", cfg.Debug, "Expose /debug/status with session, disk and memory figures, and rehash files on verify mismatches")
+	flag.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "Bearer token enabling /admin/sessions and /admin/purge (prefer SPEEDTEST_ADMIN_TOKEN; empty disables)")
+	flag.Parse()
+
+	// Remember what was given on the command line before the file overwrites the bound values
+	setOnCommandLine := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) { setOnCommandLine[f.Name] = f.Value.String() })
+
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath, &cfg); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+	}
+	if err := applyOverrides(flag.CommandLine, setOnCommandLine); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	if *selfTest {
+		if err := runSelfTest(cfg, os.Stdout); err != nil {
+			log.Fatalf("Self-test failed: %v", err)
+		}
+		return
+	}
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.OTLPEndpoint != "" {
+		var err error
+		if shutdownTracing, err = setupTracing(context.Background(), cfg.OTLPEndpoint); err != nil {
+			log.Fatalf("Tracing setup failed: %v", err)
+		}
+		log.Printf("Sending traces to %s", cfg.OTLPEndpoint)
+	}
+
+	ipFilter, err := handlers.NewIPFilter(cfg.AllowCIDRs, cfg.DenyCIDRs, "/healthz")
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	go reloadOnHangup(ipFilter, *configPath, setOnCommandLine)
+
+	downloadHandler := handlers.NewDownloadHandler(cfg.Config)
+	r := newRouter(cfg, downloadHandler, ipFilter)
+
+	var handler http.Handler = r
+	if cfg.H2C {
+		handler = h2c.NewHandler(r, &http2.Server{})
+	}
+
+	srv := &http.Server{
+		Addr:        cfg.Addr,
+		Handler:     handler,
+		ConnContext: handlers.ConnContext,
+	}
+
+	ln, where, err := listen(cfg)
+	if err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+
+	var grpcSrv *grpc.Server
+	if cfg.GRPCAddr != "" {
+		grpcLn, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			log.Fatalf("gRPC server failed: %v", err)
+		}
+		grpcSrv = newGRPCServer(r)
+		log.Printf("gRPC interface listening on %s", cfg.GRPCAddr)
+		go func() {
+			if err := grpcSrv.Serve(grpcLn); err != nil {
+				log.Printf("gRPC server: %v", err)
+			}
+		}()
+	}
+
+	// Shut down cleanly on SIGINT/SIGTERM; closing a Unix listener also removes its socket file
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		<-ctx.Done()
+		log.Println("Shutting down")
+		if grpcSrv != nil {
+			grpcSrv.GracefulStop()
+		}
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+	}()
+
+	if cfg.TLSCert != "" {
+		// HTTP/2 is negotiated automatically via ALPN when serving TLS
+		log.Printf("Speed test server listening on %s (TLS)", where)
+		err = srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+	} else {
+		log.Printf("Speed test server %s (%s) listening on %s", handlers.Version, handlers.Commit, where)
+		err = srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Server failed: %v", err)
+	}
+	<-stopped
+	if err := downloadHandler.Close(); err != nil {
+		log.Printf("Closing GeoIP database: %v", err)
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Printf("Flushing traces: %v", err)
+	}
+}
+
+// newRouter registers every route of the API on a new router. Requests are checked against
+// ipFilter, when given, before any handler runs.
+func newRouter(cfg serverConfig, downloadHandler *handlers.DownloadHandler, ipFilter *handlers.IPFilter) *mux.Router {
 	r := mux.NewRouter()
+	clientIP := handlers.ClientIP(cfg.TrustedProxies)
+	filter := func(next http.Handler) http.Handler { return next }
+	if ipFilter != nil {
+		filter = ipFilter.Middleware
+	}
+	r.Use(handlers.RequestID, clientIP, handlers.AccessLog, filter, handlers.LimitInFlight(cfg.MaxInFlight, "/healthz"), handlers.Recover)
+	if cfg.OTLPEndpoint != "" {
+		r.Use(handlers.Trace)
+	}
+	// Middleware only runs for matched routes, so the error handlers are wrapped explicitly
+	r.MethodNotAllowedHandler = handlers.RequestID(clientIP(handlers.AccessLog(filter(handlers.MethodNotAllowed(r)))))
+	r.NotFoundHandler = handlers.RequestID(clientIP(handlers.AccessLog(filter(http.HandlerFunc(handlers.NotFound)))))
 	// POST /download/init with JSON {"size_mb":10} for example
 	r.HandleFunc("/download/init", downloadHandler.InitDownload).Methods("POST")
-	// GET /download/data?session_id=UUID
-	r.HandleFunc("/download/data", downloadHandler.DownloadData).Methods("GET")
+	// GET /download/init?size_mb=10 for clients that can't easily POST JSON
+	r.HandleFunc("/download/init", downloadHandler.InitDownloadQuery).Methods("GET")
+	// POST /download/init/batch with JSON {"sizes_mb":[5,10,20]} to create several sessions at once
+	r.HandleFunc("/download/init/batch", downloadHandler.InitDownloadBatch).Methods("POST")
+	// GET /download/data?session_id=UUID; HEAD returns the size and ETag without transferring anything
+	r.HandleFunc("/download/data", downloadHandler.DownloadData).Methods("GET", "HEAD")
+	// GET /download/raw?size_mb=10 streams random data without a session; the speed is in the trailers
+	r.HandleFunc("/download/raw", downloadHandler.DownloadRaw).Methods("GET")
 	// POST /download/verify with JSON {"session_id":"XYZ","computed_hash":"..."}
 	r.HandleFunc("/download/verify", downloadHandler.VerifyDownload).Methods("POST")
+	// GET /download/blocks?session_id=UUID for per-block hashes that locate corruption
+	r.HandleFunc("/download/blocks", downloadHandler.GetBlockHashes).Methods("GET")
+	// POST /download/{session_id}/keepalive to push back a session's expiry
+	r.HandleFunc("/download/{session_id}/keepalive", downloadHandler.Keepalive).Methods("POST")
+	// GET /download/sizes
+	r.HandleFunc("/download/sizes", downloadHandler.GetSizes).Methods("GET")
+	// GET /download/next-size?session_id=UUID to pick the size of the next test
+	r.HandleFunc("/download/next-size", downloadHandler.GetNextSize).Methods("GET")
 	// GET /download/speed
 	r.HandleFunc("/download/speed", downloadHandler.GetSpeed).Methods("GET")
+	// POST /upload/data?session_id=UUID with the upload payload as the body
+	r.HandleFunc("/upload/data", downloadHandler.UploadData).Methods("POST")
+	// GET /ping or /ping?session_id=UUID to record RTT samples on a session
+	r.HandleFunc("/ping", downloadHandler.Ping).Methods("GET")
+	// GET /ping/ws upgrades to a WebSocket that echoes every frame, for RTTs without HTTP overhead
+	r.HandleFunc("/ping/ws", downloadHandler.PingWS).Methods("GET")
+	// POST /test/full with JSON {"size_mb":10} to start a combined ping/download/upload test
+	r.HandleFunc("/test/full", downloadHandler.InitFullTest).Methods("POST")
+	// GET /test/full?session_id=UUID for the combined result
+	r.HandleFunc("/test/full", downloadHandler.GetFullTestResult).Methods("GET")
+	// GET /test/duplex?session_id=UUID for the result of a simultaneous download and upload
+	r.HandleFunc("/test/duplex", downloadHandler.GetDuplexResult).Methods("GET")
+	// GET /stats
+	r.HandleFunc("/stats", downloadHandler.GetStats).Methods("GET")
+	// GET /results?ip=&since=&until=&last=
+	r.HandleFunc("/results", downloadHandler.GetResults).Methods("GET")
+	// GET /results.csv with the same filters
+	r.HandleFunc("/results.csv", downloadHandler.GetResultsCSV).Methods("GET")
+	// GET /summary?ip=&since=&until=&last=
+	r.HandleFunc("/summary", downloadHandler.GetSummary).Methods("GET")
+	// GET /whoami
+	r.HandleFunc("/whoami", downloadHandler.WhoAmI).Methods("GET")
+	// GET /version
+	r.HandleFunc("/version", handlers.GetVersion).Methods("GET")
+	// GET /healthz for load balancers and orchestrators; never refused for load
+	r.HandleFunc("/healthz", handlers.Healthz).Methods("GET")
+	if cfg.Debug {
+		// GET /debug/status
+		r.HandleFunc("/debug/status", downloadHandler.DebugStatus).Methods("GET")
+	}
+	if cfg.FixtureDir != "" {
+		// GET /download/fixture?name=foo
+		r.HandleFunc("/download/fixture", downloadHandler.DownloadFixture).Methods("GET", "HEAD")
+	}
+	if cfg.AdminToken != "" {
+		// GET /admin/sessions with "Authorization: Bearer <token>"
+		r.Handle("/admin/sessions", downloadHandler.RequireAdmin(http.HandlerFunc(downloadHandler.AdminSessions))).Methods("GET")
+		// POST /admin/purge with "Authorization: Bearer <token>" deletes every session and its files
+		r.Handle("/admin/purge", downloadHandler.RequireAdmin(http.HandlerFunc(downloadHandler.AdminPurge))).Methods("POST")
+	}
+	if cfg.Pprof {
+		// Profiles are security-sensitive, so they are only routed when explicitly requested.
+		// Importing net/http/pprof also registers on http.DefaultServeMux, which is never served.
+		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+		log.Println("pprof handlers enabled under /debug/pprof/")
+	}
+	return r
+}
 
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: r,
+// reloadOnHangup reloads the IP allow and deny lists into ipFilter on every SIGHUP. Lists that
+// don't parse are logged and the current ones stay in force.
+func reloadOnHangup(ipFilter *handlers.IPFilter, configPath string, setOnCommandLine map[string]string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		allow, deny, err := reloadIPLists(configPath, setOnCommandLine)
+		if err == nil {
+			err = ipFilter.Update(allow, deny)
+		}
+		if err != nil {
+			log.Printf("Reloading IP lists failed, keeping the current ones: %v", err)
+			continue
+		}
+		log.Printf("Reloaded IP lists: allow %q, deny %q", allow, deny)
 	}
+}
 
-	log.Println("Speed test server listening on :8080")
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+// listen opens the Unix socket when one is configured and the TCP address otherwise. A socket file
+// left behind by a previous run is removed first. It also returns a description for the logs.
+func listen(cfg serverConfig) (net.Listener, string, error) {
+	if cfg.Unix == "" {
+		ln, err := net.Listen("tcp", cfg.Addr)
+		return ln, cfg.Addr, err
+	}
+
+	if info, err := os.Stat(cfg.Unix); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, "", fmt.Errorf("%s exists and is not a socket", cfg.Unix)
+		}
+		if err := os.Remove(cfg.Unix); err != nil {
+			return nil, "", err
+		}
 	}
+	ln, err := net.Listen("unix", cfg.Unix)
+	return ln, "unix:" + cfg.Unix, err
 }
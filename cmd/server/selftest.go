@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"speedtest/internal/handlers"
+)
+
+// selfTestResult is what one size of the self-test measured
+type selfTestResult struct {
+	Generate  time.Duration // Round trip of /download/init, which generates and hashes the file
+	Hash      time.Duration // Time the client spent hashing the download
+	SpeedMbps float64       // Throughput the server measured for /download/data
+}
+
+// runSelfTest serves the API on a loopback port and downloads and verifies every allowed size
+// through it, printing one line per size. It lets operators check that a machine's disk and CPU keep
+// up without an external client.
+func runSelfTest(cfg serverConfig, out io.Writer) error {
+	// Generation is what's being measured, so no pre-generated or shared files, and the larger sizes
+	// must not be refused by the rate limiter
+	cfg.PoolSize = 0
+	cfg.ShareFiles = false
+	cfg.RateLimitPerMB = 0
+	cfg.MaxTotalMbps = 0
+	cfg.FixtureDir = ""
+
+	// A directory of its own on the first data disk, so the startup sweep for orphaned files can't
+	// touch those of a server running on the same data directory
+	dataDir := strings.TrimSpace(strings.Split(cfg.DataDir, ",")[0])
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return err
+	}
+	selfTestDir, err := os.MkdirTemp(dataDir, "selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(selfTestDir)
+	cfg.DataDir = selfTestDir
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	downloadHandler := handlers.NewDownloadHandler(cfg.Config)
+	defer downloadHandler.Close()
+	srv := &http.Server{Handler: newRouter(cfg, downloadHandler, nil)}
+	go srv.Serve(ln)
+	defer srv.Close()
+	base := "http://" + ln.Addr().String()
+
+	var sizes handlers.SizesResponse
+	if err := selfTestCall(http.MethodGet, base+"/download/sizes", nil, &sizes); err != nil {
+		return err
+	}
+
+	// Fixed-width columns, so each size can be printed as soon as it finishes
+	const row = "%7v  %10v  %10v  %15v\n"
+	fmt.Fprintf(out, row, "SIZE MB", "GENERATE", "HASH", "THROUGHPUT MBPS")
+	for _, sizeMB := range sizes.SizesMB {
+		res, err := selfTestSize(base, sizeMB)
+		if err != nil {
+			return fmt.Errorf("%d MB: %w", sizeMB, err)
+		}
+		fmt.Fprintf(out, row, sizeMB, res.Generate.Round(time.Millisecond), res.Hash.Round(time.Millisecond),
+			strconv.FormatFloat(res.SpeedMbps, 'f', 2, 64))
+	}
+	return nil
+}
+
+// selfTestSize runs init, download and verify for one size, hashing the body as it arrives like a
+// real client would
+func selfTestSize(base string, sizeMB int) (selfTestResult, error) {
+	var res selfTestResult
+
+	start := time.Now()
+	var session handlers.DownloadInitResponse
+	if err := selfTestCall(http.MethodPost, base+"/download/init", handlers.DownloadInitRequest{SizeMB: sizeMB}, &session); err != nil {
+		return res, err
+	}
+	res.Generate = time.Since(start)
+
+	req, err := http.NewRequest(http.MethodGet, base+"/download/data?session_id="+session.SessionID, nil)
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("TE", "trailers")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, selfTestError(resp)
+	}
+	hasher := &timedHash{Hash: sha256.New()}
+	if _, err := io.Copy(hasher, resp.Body); err != nil {
+		return res, err
+	}
+	res.Hash = hasher.elapsed
+	// Trailers are only populated once the body has been read to the end
+	if res.SpeedMbps, err = strconv.ParseFloat(resp.Trailer.Get(handlers.TrailerSpeedMbps), 64); err != nil {
+		return res, fmt.Errorf("reading %s trailer: %w", handlers.TrailerSpeedMbps, err)
+	}
+
+	verify := handlers.DownloadVerifyRequest{
+		SessionID:    session.SessionID,
+		ComputedHash: hex.EncodeToString(hasher.Sum(nil)),
+	}
+	var verified handlers.DownloadVerifyResponse
+	if err := selfTestCall(http.MethodPost, base+"/download/verify", verify, &verified); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// selfTestCall sends body (if any) as JSON and decodes a successful response into result
+func selfTestCall(method, url string, body, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return selfTestError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// selfTestError turns an error response into an error naming the request and the API error code
+func selfTestError(resp *http.Response) error {
+	var apiErr handlers.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+		return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	}
+	return fmt.Errorf("%s %s: %s: %s (%s)", resp.Request.Method, resp.Request.URL.Path, resp.Status, apiErr.Error, apiErr.Code)
+}
+
+// timedHash is a hash that adds up the time spent in Write
+type timedHash struct {
+	hash.Hash
+	elapsed time.Duration
+}
+
+func (t *timedHash) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.Hash.Write(p)
+	t.elapsed += time.Since(start)
+	return n, err
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// minTokenLength keeps the admin and rate limit bypass tokens from being trivially guessable
+const minTokenLength = 16
+
+type AdminSession struct {
+	SessionID         string    `json:"session_id"`
+	SizeBytes         int64     `json:"size_bytes"` // 0 for timed sessions
+	DurationSec       int       `json:"duration_sec,omitempty"`
+	AgeSec            float64   `json:"age_sec"`
+	ClientIP          string    `json:"client_ip"`
+	DownloadSpeedMbps float64   `json:"download_speed_mbps"`
+	Status            string    `json:"status"`
+	ActiveDownloads   int       `json:"active_downloads"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+type AdminPurgeResponse struct {
+	PurgedSessions int `json:"purged_sessions"`
+	FailedRemovals int `json:"failed_removals"` // Files that could not be deleted; see the server log
+}
+
+// RequireAdmin only lets requests carrying the admin token as a bearer token through to next. The
+// token is compared in constant time.
+func (h *DownloadHandler) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSONError(w, http.StatusUnauthorized, CodeUnauthorized, "A valid admin token is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminSessions lists every active session, oldest first
+func (h *DownloadHandler) AdminSessions(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	h.mu.Lock()
+	sessions := make([]AdminSession, 0, len(h.sessions))
+	for sessionID, sess := range h.sessions {
+		status := sess.DownloadStatus
+		if status == "" {
+			status = DownloadPending
+		}
+		sessions = append(sessions, AdminSession{
+			SessionID:         sessionID,
+			SizeBytes:         sess.FileSize,
+			DurationSec:       int(sess.Duration / time.Second),
+			AgeSec:            now.Sub(sess.CreatedAt).Seconds(),
+			ClientIP:          sess.ClientIP,
+			DownloadSpeedMbps: sess.DownloadSpeedMbps,
+			Status:            status,
+			ActiveDownloads:   sess.activeDownloads,
+			ExpiresAt:         h.sessionExpiry(sess),
+		})
+	}
+	h.mu.Unlock()
+
+	slices.SortFunc(sessions, func(a, b AdminSession) int {
+		return cmp.Compare(b.AgeSec, a.AgeSec)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// AdminPurge deletes every session and its files at once, to reclaim disk space without a restart.
+// Purged sessions answer 410 afterwards, like expired ones. Downloads already running finish from
+// their open file.
+func (h *DownloadHandler) AdminPurge(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var resp AdminPurgeResponse
+
+	h.mu.Lock()
+	for sessionID, sess := range h.sessions {
+		if err := h.removeSessionFile(sess); err != nil {
+			log.Printf("Failed to delete file %s: %v", sess.FilePath, err)
+			resp.FailedRemovals++
+		}
+		delete(h.sessions, sessionID)
+		h.expiredSessions[sessionID] = now
+		resp.PurgedSessions++
+	}
+	h.mu.Unlock()
+
+	log.Printf("Admin purge removed %d sessions (%d files could not be deleted)", resp.PurgedSessions, resp.FailedRemovals)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
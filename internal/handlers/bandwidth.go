@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// bandwidthBurst is how long the bucket may save up unused budget, bounding the burst after a
+	// quiet spell
+	bandwidthBurst = 50 * time.Millisecond
+	// throttleChunkSize bounds the bytes one write takes from the bucket at a time, so concurrent
+	// responses interleave instead of one big write starving the others
+	throttleChunkSize = 64 * 1024
+	// utilizationWindow is how often the measured outgoing rate is refreshed
+	utilizationWindow = time.Second
+)
+
+// bandwidthBucket is a token bucket of bytes shared by every download response, capping the total
+// rate the server sends at no matter how many clients download at once
+type bandwidthBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64 // May go negative: writers that overdraw wait until it is paid back
+	last   time.Time
+
+	windowStart time.Time
+	windowBytes int64
+	measured    float64 // Bytes per second over the last full utilizationWindow
+}
+
+func newBandwidthBucket(mbps float64) *bandwidthBucket {
+	rate := mbps * 1e6 / 8
+	now := time.Now()
+	return &bandwidthBucket{
+		rate:        rate,
+		burst:       max(rate*bandwidthBurst.Seconds(), throttleChunkSize),
+		last:        now,
+		windowStart: now,
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before sending them. Writers
+// queue in the order they reserve, which keeps concurrent responses at a fair share.
+func (b *bandwidthBucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	if elapsed := now.Sub(b.windowStart); elapsed >= utilizationWindow {
+		b.measured = float64(b.windowBytes) / elapsed.Seconds()
+		b.windowStart = now
+		b.windowBytes = 0
+	}
+	b.windowBytes += int64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// utilization returns the recently measured outgoing rate in Mbps and as a fraction of the cap
+func (b *bandwidthBucket) utilization(now time.Time) (float64, float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	measured := b.measured
+	if now.Sub(b.windowStart) >= 2*utilizationWindow {
+		measured = 0 // Nothing has been sent for a while
+	}
+	return measured * 8 / 1e6, measured / b.rate
+}
+
+// throttledWriter paces a response's writes by the shared bandwidth bucket. It leaves out ReadFrom,
+// so sendfile can't bypass it.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	bucket *bandwidthBucket
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunkSize)]
+		if wait := tw.bucket.reserve(len(chunk), time.Now()); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-tw.ctx.Done():
+				timer.Stop()
+				return written, tw.ctx.Err()
+			}
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// throttle wraps w so the response draws from the server-wide bandwidth budget, when one is
+// configured
+func (h *DownloadHandler) throttle(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if h.bandwidth == nil {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), bucket: h.bandwidth}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// maxBatchSizes bounds how many sessions one batch init may create
+	maxBatchSizes = 8
+	// batchWorkers is how many files a batch init generates at once
+	batchWorkers = 4
+)
+
+type DownloadInitBatchRequest struct {
+	SizesMB []int             `json:"sizes_mb"`
+	Tags    map[string]string `json:"tags,omitempty"` // Applied to every session in the batch
+}
+
+// BatchInitResult is the outcome for one requested size: the init response when its session was
+// created, or an error
+type BatchInitResult struct {
+	SizeMB int `json:"size_mb"`
+	*DownloadInitResponse
+	Error string    `json:"error,omitempty"`
+	Code  ErrorCode `json:"code,omitempty"`
+}
+
+// InitDownloadBatch creates one session per requested size, generating the files concurrently. Sizes
+// that fail are reported individually while the rest of the batch still succeeds. A batch is
+// charged the total of its sizes by the rate limiter.
+func (h *DownloadHandler) InitDownloadBatch(w http.ResponseWriter, r *http.Request) {
+	var req DownloadInitBatchRequest
+	if !decodeJSONBody(w, r, &req, maxInitBodyBytes) {
+		return
+	}
+	if len(req.SizesMB) == 0 || len(req.SizesMB) > maxBatchSizes {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "sizes_mb must list between 1 and "+strconv.Itoa(maxBatchSizes)+" sizes")
+		return
+	}
+	if err := validateTags(req.Tags); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidTags, "Invalid tags: "+err.Error())
+		return
+	}
+	costMB := 0
+	for _, sizeMB := range req.SizesMB {
+		costMB += initCostMB(DownloadInitRequest{SizeMB: sizeMB})
+	}
+	if !h.checkLoad(w) {
+		return
+	}
+	if !h.checkCapacity(w, len(req.SizesMB)) {
+		return
+	}
+	if !h.checkRateLimit(w, r, costMB) {
+		return
+	}
+
+	results := make([]BatchInitResult, len(req.SizesMB))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(batchWorkers, len(req.SizesMB)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = h.initBatchSession(r, req.SizesMB[i], req.Tags)
+			}
+		}()
+	}
+	for i := range req.SizesMB {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Partial success is still success; only a batch where nothing could be created is an error,
+	// and then a client error unless some file failed to generate or couldn't get a generation slot
+	status := http.StatusBadRequest
+	for _, result := range results {
+		if result.DownloadInitResponse != nil {
+			status = http.StatusOK
+			break
+		}
+		switch {
+		case result.Code == CodeServerBusy:
+			status = http.StatusServiceUnavailable
+		case result.Code == CodeInternal && status != http.StatusServiceUnavailable:
+			status = http.StatusInternalServerError
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("Error encoding batch init response: %v", err)
+	}
+}
+
+// initBatchSession creates the session for one size of a batch
+func (h *DownloadHandler) initBatchSession(r *http.Request, sizeMB int, tags map[string]string) BatchInitResult {
+	result := BatchInitResult{SizeMB: sizeMB}
+
+	size, ok := allowedSizes[sizeMB]
+	if !ok {
+		result.Error = invalidSizeMessage()
+		result.Code = CodeInvalidSize
+		return result
+	}
+
+	sess := &Session{
+		FileSize:      h.jitterSize(size, nil),
+		HashAlgorithm: "sha256",
+		ClientIP:      getClientIP(r),
+		Tags:          tags,
+	}
+	sessionID, err := h.createSession(r.Context(), sess)
+	if errors.Is(err, errGenerationBusy) {
+		result.Error = "Too many test files are being generated"
+		result.Code = CodeServerBusy
+		return result
+	}
+	if err != nil {
+		log.Printf("Error creating batch session for %d MB: %v", sizeMB, err)
+		result.Error = "Could not create session"
+		result.Code = CodeInternal
+		return result
+	}
+
+	resp := h.newInitResponse(sessionID, sess)
+	result.DownloadInitResponse = &resp
+	return result
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// blockSize is the size of the blocks hashed by GetBlockHashes. The last block may be shorter.
+const blockSize = 1024 * 1024
+
+type BlockHashesResponse struct {
+	SessionID     string   `json:"session_id"`
+	BlockSize     int      `json:"block_size"`
+	HashAlgorithm string   `json:"hash_algorithm"`
+	BlockHashes   []string `json:"block_hashes"` // One per block, in file order
+}
+
+// GetBlockHashes returns the SHA-256 hash of every blockSize block of a session's file, so a client
+// whose full hash mismatched can find which part of the download was corrupted. They are computed on
+// the first request and cached in the session.
+func (h *DownloadHandler) GetBlockHashes(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		writeJSONError(w, http.StatusBadRequest, CodeSessionIDRequired, "session_id is required")
+		return
+	}
+
+	h.mu.Lock()
+	sess, status := h.findSession(sessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
+		return
+	}
+	if sess.Duration > 0 || sess.Diskless {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "Timed and diskless sessions have no file to hash")
+		return
+	}
+	blockHashes, filePath := sess.BlockHashes, sess.FilePath
+	h.mu.Unlock()
+
+	if blockHashes == nil {
+		// Hashing a large file takes a while, so it is done without holding the lock
+		release, ok := h.acquireHashSlot(w, r)
+		if !ok {
+			return
+		}
+		var err error
+		_, span := startSpan(r.Context(), "hash")
+		blockHashes, err = computeBlockHashes(filePath)
+		endSpan(span, err)
+		release()
+		if err != nil {
+			h.mu.Lock()
+			current, status := h.findSession(sessionID)
+			h.mu.Unlock()
+			if current != sess {
+				// Verified or expired meanwhile, taking its file with it
+				writeSessionError(w, status)
+				return
+			}
+			log.Printf("Error hashing blocks of %s: %v", filePath, err)
+			writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+			return
+		}
+		h.mu.Lock()
+		sess.BlockHashes = blockHashes
+		h.mu.Unlock()
+	}
+
+	resp := BlockHashesResponse{
+		SessionID:     sessionID,
+		BlockSize:     blockSize,
+		HashAlgorithm: "sha256",
+		BlockHashes:   blockHashes,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// computeBlockHashes hashes the file at path in blockSize blocks
+func computeBlockHashes(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hashes []string
+	hasher := sha256.New()
+	for {
+		hasher.Reset()
+		n, err := io.CopyN(hasher, f, blockSize)
+		if n > 0 {
+			hashes = append(hashes, hex.EncodeToString(hasher.Sum(nil)))
+		}
+		if err == io.EOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// maxInitBodyBytes bounds init request bodies. The largest legitimate one, a batch with the most
+// tags allowed, is a few KB.
+const maxInitBodyBytes = 64 * 1024
+
+// decodeJSONBody decodes a request body of at most limit bytes into dst. It insists on an
+// application/json Content-Type (415), a body within the limit (413), and a single JSON value
+// without unknown fields (400). On failure it writes the error response itself and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any, limit int64) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, CodeBadMediaType, "Content-Type must be application/json")
+		return false
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(dst)
+	if err == nil {
+		// Anything after the first value is a mistake too
+		if err = dec.Decode(&struct{}{}); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errors.New("body must contain a single JSON object")
+		}
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("Request body must not exceed %d bytes", limit))
+	default:
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, "Bad request: "+err.Error())
+	}
+	return false
+}
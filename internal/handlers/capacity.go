@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ServerBusyResponse is the body returned when the server already has MaxSessions active sessions.
+// It carries the counts so a client choosing among servers can tell how full this one is.
+type ServerBusyResponse struct {
+	Error  string    `json:"error"`
+	Code   ErrorCode `json:"code"`
+	Active int       `json:"active"`
+	Max    int       `json:"max"`
+}
+
+// checkCapacity refuses with 503 when creating n more sessions would exceed MaxSessions, so clients
+// fail fast and can pick another server. It writes the error response itself and returns false when
+// the request should not go ahead. Concurrent inits may overshoot the cap slightly.
+func (h *DownloadHandler) checkCapacity(w http.ResponseWriter, n int) bool {
+	if h.cfg.MaxSessions <= 0 {
+		return true
+	}
+	h.mu.Lock()
+	active := len(h.sessions)
+	h.mu.Unlock()
+	if active+n <= h.cfg.MaxSessions {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(ServerBusyResponse{
+		Error:  "server_busy",
+		Code:   CodeServerBusy,
+		Active: active,
+		Max:    h.cfg.MaxSessions,
+	})
+	return false
+}
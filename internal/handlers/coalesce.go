@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+)
+
+// coalescedFile is the outcome of one generation shared by concurrent inits of the same size
+type coalescedFile struct {
+	path string
+	hash string
+}
+
+// prepareCoalesced generates a random file of size at path like prepareFile, but concurrent callers
+// for the same size share a single generation: the first generates at its own path, and the others
+// hard link their path to that file once it is ready. Sessions still own their paths, so releasing
+// one leaves the others' files in place. A caller that can't link, because the file already went
+// away, lives on another file system or the generating request was cancelled, falls back to
+// generating on its own.
+func (h *DownloadHandler) prepareCoalesced(ctx context.Context, path string, size int64) (string, error) {
+	v, err, shared := h.generations.Do(strconv.FormatInt(size, 10), func() (any, error) {
+		hash, err := h.prepareFile(ctx, path, size, nil, GenerationRandom)
+		return coalescedFile{path: path, hash: hash}, err
+	})
+	cf := v.(coalescedFile)
+	if !shared || cf.path == path {
+		return cf.hash, err
+	}
+	if err == nil {
+		if err = os.Link(cf.path, path); err == nil {
+			return cf.hash, nil
+		}
+	} else if !errors.Is(err, context.Canceled) || ctx.Err() != nil {
+		return "", err
+	}
+	return h.prepareFile(ctx, path, size, nil, GenerationRandom)
+}
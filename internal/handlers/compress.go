@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// wantsGzip reports whether the client asked for a gzip-compressed download with compress=gzip and
+// also advertises gzip support. Test payloads are served uncompressed otherwise.
+func wantsGzip(r *http.Request) bool {
+	if r.URL.Query().Get("compress") != "gzip" {
+		return false
+	}
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, _, _ := strings.Cut(coding, ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveGzip writes src to cw gzip-compressed, so cw counts the compressed bytes on the wire. A read
+// error is recorded in cw.err like a write error, marking the transfer incomplete.
+func serveGzip(cw *countingWriter, src io.Reader) {
+	header := cw.Header()
+	header.Set("Content-Encoding", "gzip")
+	header.Set("Content-Type", "application/octet-stream")
+	header.Add("Vary", "Accept-Encoding")
+
+	gz := gzip.NewWriter(cw)
+	_, err := io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+}
+
+// compressionRatio is the payload size over the bytes that crossed the wire for it. Random payloads
+// barely compress, so expect values close to (or just under) 1.
+func compressionRatio(payloadBytes, wireBytes int64) float64 {
+	if wireBytes <= 0 {
+		return 0
+	}
+	return float64(payloadBytes) / float64(wireBytes)
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Bounds for Config.GenerateBufferKB
+const (
+	MinGenerateBufferKB = 64
+	MaxGenerateBufferKB = 16 * 1024
+)
+
+// Bounds for Config.HashBufferKB
+const (
+	MinHashBufferKB = 32
+	MaxHashBufferKB = 16 * 1024
+)
+
+// MaxSizeJitterBytes bounds Config.SizeJitterBytes; the padding is meant to be small next to the file
+const MaxSizeJitterBytes = 1024 * 1024
+
+// Config holds the tunable settings of a DownloadHandler. The yaml keys are used by the server's
+// config file and match its flag names.
+type Config struct {
+	// DataDir is where test files are written. Session files never resolve outside of it. Several
+	// directories, e.g. one per disk, can be given separated by commas; new files are then placed on
+	// them in turn.
+	DataDir string `yaml:"data_dir"`
+
+	// PoolSize is the number of pre-generated files kept ready for each allowed size. 0 disables the pool.
+	PoolSize int `yaml:"pool"`
+
+	// ShareFiles backs all sessions of the same size with one immutable, reference-counted file
+	// instead of generating a file per session. Takes precedence over the pool.
+	ShareFiles bool `yaml:"share_files"`
+
+	// Diskless streams sessions straight from crypto/rand instead of generating files, for read-only
+	// or memory-backed roots. Each download sends different data, hashed as it goes; options that
+	// need a file (ranges, seeds, compressible content, block hashes) are unavailable.
+	Diskless bool `yaml:"diskless"`
+
+	// SizeJitterBytes pads each session's file by a random number of bytes up to this many, so no two
+	// responses are alike and a cache in the path can't answer a download with an earlier one. The
+	// init response reports the padded size. 0 disables it.
+	SizeJitterBytes int `yaml:"size_jitter_bytes"`
+
+	// CoalesceInits lets concurrent inits of the same size share one generation, hard linking the
+	// result into each session's own file, so a burst generates a file once rather than per client.
+	// Those sessions get identical content. Has no effect with ShareFiles, which already shares.
+	CoalesceInits bool `yaml:"coalesce_inits"`
+
+	// GenerateBufferKB is the buffer size used when generating random test data. Smaller buffers
+	// save memory on constrained devices; larger ones may generate faster.
+	GenerateBufferKB int `yaml:"gen_buffer_kb"`
+
+	// FsyncFiles makes each generated file reach the disk before its session is handed out, so inits
+	// exercise the disk rather than only the page cache. Inits take as much longer as the disk needs
+	// to absorb the file.
+	FsyncFiles bool `yaml:"fsync_files"`
+
+	// DirectIO writes generated files with O_DIRECT, bypassing the page cache (Linux only). Writes
+	// then run at the disk's own speed, large files are generated as one stream rather than in
+	// parallel, and downloads start out reading from disk instead of memory.
+	DirectIO bool `yaml:"direct_io"`
+
+	// HashBufferKB is the buffer size used when reading files back from disk to hash them. Larger
+	// buffers mean fewer read syscalls on big files.
+	HashBufferKB int `yaml:"hash_buffer_kb"`
+
+	// MaxResponseDelay caps the delay_ms parameter accepted by /ping and /download/init. 0 disables
+	// simulated delays entirely.
+	MaxResponseDelay time.Duration `yaml:"max_delay"`
+
+	// SessionTTL is how long a session stays usable after init. Expired sessions answer 410 Gone.
+	SessionTTL time.Duration `yaml:"session_ttl"`
+
+	// MaxResults is how many verification results /results and /summary keep in memory, oldest
+	// dropped first. 0 disables the history.
+	MaxResults int `yaml:"max_results"`
+
+	// ResultMaxAge drops results older than this, checked by the cleanup goroutine. 0 keeps them
+	// until MaxResults pushes them out.
+	ResultMaxAge time.Duration `yaml:"result_max_age"`
+
+	// IdempotencyTTL is how long an Idempotency-Key on /download/init keeps returning its original session
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl"`
+
+	// RateLimitPerMB is how long each MB requested at init costs a client against the rate limit.
+	// 0 disables rate limiting.
+	RateLimitPerMB time.Duration `yaml:"rate_limit_per_mb"`
+
+	// RateLimitBurst is how far ahead of its allowance a client may run before inits are refused
+	RateLimitBurst time.Duration `yaml:"rate_limit_burst"`
+
+	// RateLimitBypassToken exempts requests presenting it in X-Bypass-Token from the rate limit, for
+	// monitors that test on a tight schedule. Empty disables the bypass.
+	RateLimitBypassToken string `yaml:"rate_limit_bypass_token"`
+
+	// MaxGenerations is how many test files may be generated at once. Further inits queue for a
+	// slot. 0 removes the limit.
+	MaxGenerations int `yaml:"max_generations"`
+
+	// GenerationWait is how long an init queues for a generation slot before it gets 503
+	GenerationWait time.Duration `yaml:"generation_wait"`
+
+	// MaxHashers is how many files may be read back and hashed at once, for computed_hashes,
+	// verify_bytes, block hashes and debug rehashes. Further requests queue for a slot. 0 removes
+	// the limit.
+	MaxHashers int `yaml:"max_hashers"`
+
+	// HashWait is how long a request queues for a hashing slot before it gets 503
+	HashWait time.Duration `yaml:"hash_wait"`
+
+	// MaxLoadAverage is the 1-minute load average above which inits are refused with 503, so the
+	// speed test backs off on a busy host. Linux only; 0 disables the check.
+	MaxLoadAverage float64 `yaml:"max_load"`
+
+	// MaxSessions is how many sessions may be active at once before inits get 503. 0 removes the cap.
+	MaxSessions int `yaml:"max_sessions"`
+
+	// MaxInFlight is how many HTTP requests may be served at once, across all clients, before further
+	// ones get 503. /healthz is exempt. 0 removes the cap.
+	MaxInFlight int `yaml:"max_in_flight"`
+
+	// MaxConnections is how many parallel downloads a single session may run
+	MaxConnections int `yaml:"max_connections"`
+
+	// MaxDownloadsPerSession is how many /download/data requests a session serves in total before it
+	// counts as consumed and answers 410. Every request counts, including each Range request of a
+	// parallel download. 0 means unlimited.
+	MaxDownloadsPerSession int `yaml:"max_downloads_per_session"`
+
+	// MinBandwidthMbps is the slowest transfer rate /download/data tolerates. Each transfer gets a
+	// write deadline of its size at this rate plus a grace period. 0 disables the deadline.
+	MinBandwidthMbps float64 `yaml:"min_bandwidth_mbps"`
+
+	// MaxTransferDuration is the longest a single /download/data transfer may run, however slowly the
+	// client reads. It is raised to a transfer's MinBandwidthMbps deadline when that is longer, so it
+	// only shortens the per-size deadline. Transfers cut off by it are recorded as incomplete. 0
+	// disables the cap.
+	MaxTransferDuration time.Duration `yaml:"max_transfer_duration"`
+
+	// MinReliableMB is the least a download must transfer for its speed to be trusted. Speeds from
+	// smaller transfers are flagged as unreliable, since they finish too fast to measure accurately.
+	MinReliableMB int `yaml:"min_reliable_mb"`
+
+	// MaxTotalMbps caps the combined rate of all download responses, shared fairly between them, so
+	// the server doesn't monopolise its uplink. 0 disables the cap.
+	MaxTotalMbps float64 `yaml:"max_total_mbps"`
+
+	// MaxUploadMB is the largest request body accepted by the upload endpoint
+	MaxUploadMB int `yaml:"max_upload_mb"`
+
+	// GeoIPDB is the path of a MaxMind GeoLite2/GeoIP2 City database used to add country and city to
+	// results. Empty disables geolocation.
+	GeoIPDB string `yaml:"geoip_db"`
+
+	// FixtureDir holds named files with known content served by /download/fixture. They are hashed
+	// at startup. Empty disables fixtures.
+	FixtureDir string `yaml:"fixture_dir"`
+
+	// ResponseHeaders are static headers added to every /download/data and /download/raw response,
+	// e.g. to stop a reverse proxy from buffering the stream. An empty value drops a default. Only
+	// settable in the config file.
+	ResponseHeaders map[string]string `yaml:"response_headers"`
+
+	// ReverseDNS adds the client's reverse DNS hostname to results and speed reports. Lookups run in
+	// the background with a timeout and are cached, so they never delay a request.
+	ReverseDNS bool `yaml:"reverse_dns"`
+
+	// TrustedProxies is how many reverse proxies in front of the server append to X-Forwarded-For.
+	// The client IP is taken that many entries from the right; with 0 the header is ignored and the
+	// connection's remote address is used.
+	TrustedProxies int `yaml:"trusted_proxies"`
+
+	// AllowCIDRs and DenyCIDRs are comma-separated CIDRs (or single addresses) of clients that may
+	// or may not use the server. With an allowlist only matching clients get in; the denylist wins
+	// over it. Both are reloaded from the config file on SIGHUP.
+	AllowCIDRs string `yaml:"allow_cidrs"`
+	DenyCIDRs  string `yaml:"deny_cidrs"`
+
+	// Debug enables the /debug/status endpoint, and adds the server's fresh hash of the file to
+	// hash mismatches on /download/verify
+	Debug bool `yaml:"debug"`
+
+	// AdminToken enables the /admin endpoints, which require it as a bearer token. Empty disables them.
+	AdminToken string `yaml:"admin_token"`
+}
+
+// DefaultConfig returns the settings used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		DataDir:             "tmpdata",
+		PoolSize:            0,
+		GenerateBufferKB:    1024,
+		HashBufferKB:        1024,
+		MaxResponseDelay:    0,
+		SessionTTL:          time.Hour,
+		IdempotencyTTL:      10 * time.Minute,
+		MaxResults:          1000,
+		RateLimitPerMB:      100 * time.Millisecond,
+		RateLimitBurst:      10 * time.Second,
+		MaxGenerations:      4,
+		GenerationWait:      30 * time.Second,
+		MaxHashers:          4,
+		HashWait:            10 * time.Second,
+		MaxConnections:      4,
+		MinBandwidthMbps:    1,
+		MaxTransferDuration: 120 * time.Second,
+		MinReliableMB:       10,
+		MaxUploadMB:         1000,
+		// nginx buffers proxied responses by default, which makes the client measure the proxy
+		ResponseHeaders: map[string]string{"X-Accel-Buffering": "no"},
+	}
+}
+
+// Validate reports the first setting that is out of range, naming it by its config key
+func (c Config) Validate() error {
+	switch {
+	case c.DataDir == "":
+		return errors.New("data_dir must not be empty")
+	case slices.Contains(c.dataDirs(), ""):
+		return fmt.Errorf("data_dir must not contain empty directories, got %q", c.DataDir)
+	case c.PoolSize < 0:
+		return fmt.Errorf("pool must not be negative, got %d", c.PoolSize)
+	case c.Diskless && (c.PoolSize > 0 || c.ShareFiles):
+		return errors.New("diskless can't be combined with pool or share_files")
+	case c.DirectIO && !directIOSupported:
+		return errors.New("direct_io is only supported on Linux")
+	case c.SizeJitterBytes < 0 || c.SizeJitterBytes > MaxSizeJitterBytes:
+		return fmt.Errorf("size_jitter_bytes must be between 0 and %d, got %d", MaxSizeJitterBytes, c.SizeJitterBytes)
+	case c.SizeJitterBytes > 0 && (c.PoolSize > 0 || c.ShareFiles):
+		return errors.New("size_jitter_bytes can't be combined with pool or share_files, which need files of the exact sizes")
+	case c.GenerateBufferKB < MinGenerateBufferKB || c.GenerateBufferKB > MaxGenerateBufferKB:
+		return fmt.Errorf("gen_buffer_kb must be between %d and %d, got %d", MinGenerateBufferKB, MaxGenerateBufferKB, c.GenerateBufferKB)
+	case c.HashBufferKB < MinHashBufferKB || c.HashBufferKB > MaxHashBufferKB:
+		return fmt.Errorf("hash_buffer_kb must be between %d and %d, got %d", MinHashBufferKB, MaxHashBufferKB, c.HashBufferKB)
+	case c.MaxResponseDelay < 0:
+		return fmt.Errorf("max_delay must not be negative, got %s", c.MaxResponseDelay)
+	case c.SessionTTL <= 0:
+		return fmt.Errorf("session_ttl must be positive, got %s", c.SessionTTL)
+	case c.IdempotencyTTL <= 0:
+		return fmt.Errorf("idempotency_ttl must be positive, got %s", c.IdempotencyTTL)
+	case c.MaxResults < 0:
+		return fmt.Errorf("max_results must not be negative, got %d", c.MaxResults)
+	case c.ResultMaxAge < 0:
+		return fmt.Errorf("result_max_age must not be negative, got %s", c.ResultMaxAge)
+	case c.RateLimitPerMB < 0:
+		return fmt.Errorf("rate_limit_per_mb must not be negative, got %s", c.RateLimitPerMB)
+	case c.RateLimitBurst < 0:
+		return fmt.Errorf("rate_limit_burst must not be negative, got %s", c.RateLimitBurst)
+	case c.MaxGenerations < 0:
+		return fmt.Errorf("max_generations must not be negative, got %d", c.MaxGenerations)
+	case c.GenerationWait <= 0:
+		return fmt.Errorf("generation_wait must be positive, got %s", c.GenerationWait)
+	case c.MaxHashers < 0:
+		return fmt.Errorf("max_hashers must not be negative, got %d", c.MaxHashers)
+	case c.HashWait <= 0:
+		return fmt.Errorf("hash_wait must be positive, got %s", c.HashWait)
+	case c.MaxLoadAverage < 0:
+		return fmt.Errorf("max_load must not be negative, got %g", c.MaxLoadAverage)
+	case c.MaxSessions < 0:
+		return fmt.Errorf("max_sessions must not be negative, got %d", c.MaxSessions)
+	case c.MaxInFlight < 0:
+		return fmt.Errorf("max_in_flight must not be negative, got %d", c.MaxInFlight)
+	case c.MaxConnections <= 0:
+		return fmt.Errorf("max_connections must be positive, got %d", c.MaxConnections)
+	case c.MaxDownloadsPerSession < 0:
+		return fmt.Errorf("max_downloads_per_session must not be negative, got %d", c.MaxDownloadsPerSession)
+	case c.MinBandwidthMbps < 0:
+		return fmt.Errorf("min_bandwidth_mbps must not be negative, got %g", c.MinBandwidthMbps)
+	case c.MaxTransferDuration < 0:
+		return fmt.Errorf("max_transfer_duration must not be negative, got %s", c.MaxTransferDuration)
+	case c.MinReliableMB < 0:
+		return fmt.Errorf("min_reliable_mb must not be negative, got %d", c.MinReliableMB)
+	case c.MaxTotalMbps < 0:
+		return fmt.Errorf("max_total_mbps must not be negative, got %g", c.MaxTotalMbps)
+	case c.MaxUploadMB <= 0:
+		return fmt.Errorf("max_upload_mb must be positive, got %d", c.MaxUploadMB)
+	case c.FixtureDir != "" && slices.Contains(c.dataDirs(), c.FixtureDir):
+		return fmt.Errorf("fixture_dir must not be a data directory, got %q", c.FixtureDir)
+	case c.TrustedProxies < 0:
+		return fmt.Errorf("trusted_proxies must not be negative, got %d", c.TrustedProxies)
+	case c.AdminToken != "" && len(c.AdminToken) < minTokenLength:
+		return fmt.Errorf("admin_token must be at least %d characters", minTokenLength)
+	case c.RateLimitBypassToken != "" && len(c.RateLimitBypassToken) < minTokenLength:
+		return fmt.Errorf("rate_limit_bypass_token must be at least %d characters", minTokenLength)
+	}
+	if _, err := parseCIDRList(c.AllowCIDRs); err != nil {
+		return fmt.Errorf("allow_cidrs: %w", err)
+	}
+	if _, err := parseCIDRList(c.DenyCIDRs); err != nil {
+		return fmt.Errorf("deny_cidrs: %w", err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.ResponseHeaders)) {
+		switch {
+		case !httpguts.ValidHeaderFieldName(name):
+			return fmt.Errorf("response_headers: invalid header name %q", name)
+		case !httpguts.ValidHeaderFieldValue(c.ResponseHeaders[name]):
+			return fmt.Errorf("response_headers: invalid value for %s", name)
+		case slices.Contains(managedHeaders, http.CanonicalHeaderKey(name)):
+			return fmt.Errorf("response_headers: %s is set by the server and can't be overridden", name)
+		}
+	}
+	return nil
+}
+
+// dataDirs splits DataDir into its directories
+func (c Config) dataDirs() []string {
+	dirs := strings.Split(c.DataDir, ",")
+	for i, dir := range dirs {
+		dirs[i] = strings.TrimSpace(dir)
+	}
+	return dirs
+}
+
+// managedHeaders are set per response by the download handlers; overriding them would corrupt the
+// payload or its framing
+var managedHeaders = []string{"Content-Encoding", "Content-Length", "Content-Range", "Trailer", "Transfer-Encoding"}
+
+// setResponseHeaders adds the configured static headers to a download response
+func (h *DownloadHandler) setResponseHeaders(header http.Header) {
+	for name, value := range h.cfg.ResponseHeaders {
+		if value != "" {
+			header.Set(name, value)
+		}
+	}
+}
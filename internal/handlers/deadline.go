@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// transferDeadlineGrace is added to every transfer deadline to absorb connection setup and slow starts
+const transferDeadlineGrace = 10 * time.Second
+
+// transferTimeAllowed is how long sending size bytes may take at the configured minimum bandwidth.
+// It returns 0 when no floor is configured.
+func (h *DownloadHandler) transferTimeAllowed(size int64) time.Duration {
+	if h.cfg.MinBandwidthMbps <= 0 {
+		return 0
+	}
+	seconds := float64(size) * 8 / (h.cfg.MinBandwidthMbps * 1024 * 1024)
+	return time.Duration(seconds*float64(time.Second)) + transferDeadlineGrace
+}
+
+// setTransferDeadline sets a write deadline on this response only, so a stalled transfer is cut off
+// without the server needing a global WriteTimeout short enough to break large downloads. A zero
+// allowance leaves the connection's deadline untouched.
+func setTransferDeadline(w http.ResponseWriter, allowed time.Duration) {
+	if allowed <= 0 {
+		return
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(allowed)); err != nil {
+		log.Printf("Could not set write deadline: %v", err)
+	}
+}
+
+// transferCap is how long a transfer of size bytes may run in total: MaxTransferDuration, raised to
+// the size's deadline at MinBandwidthMbps, so the cap never cuts off a transfer that is keeping up
+// with the bandwidth floor. Sparse sizes are exempt, as no fixed cap suits transfers of several GB;
+// their per-size deadline still cuts off a stalled one. It returns 0 when there is no cap.
+func (h *DownloadHandler) transferCap(size int64) time.Duration {
+	if h.cfg.MaxTransferDuration <= 0 || isSparseSize(size) {
+		return 0
+	}
+	return max(h.cfg.MaxTransferDuration, h.transferTimeAllowed(size))
+}
+
+// capTransfer bounds a whole transfer of size bytes to its transferCap, however the client paces it.
+// Once the cap is reached the returned request's context is done and the write deadline is moved to
+// now, which fails the write in progress so the transfer ends as incomplete. what names the transfer
+// in the log. The returned func must be called when the transfer is over.
+func (h *DownloadHandler) capTransfer(w http.ResponseWriter, r *http.Request, size int64, what string) (*http.Request, func()) {
+	limit := h.transferCap(size)
+	if limit <= 0 {
+		return r, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), limit)
+	stop := context.AfterFunc(ctx, func() {
+		if ctx.Err() != context.DeadlineExceeded {
+			return // The client went away; nothing to cut off
+		}
+		log.Printf("%s reached the %s transfer cap; cutting it off", what, limit)
+		setTransferDeadline(w, time.Nanosecond)
+	})
+	return r.WithContext(ctx), func() {
+		// Stop the callback first, so ending normally never touches the connection's deadline
+		stop()
+		cancel()
+	}
+}
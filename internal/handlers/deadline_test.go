@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransferCapCoversPerSizeDeadline(t *testing.T) {
+	h := newTestHandler(t)
+	h.cfg.MinBandwidthMbps = 1
+	h.cfg.MaxTransferDuration = 120 * time.Second
+
+	tests := []struct {
+		sizeMB int
+		want   time.Duration
+	}{
+		{5, 120 * time.Second},     // 50s at 1 Mbps: the cap is longer
+		{1000, 8010 * time.Second}, // 8000s at 1 Mbps plus grace
+	}
+	for _, tt := range tests {
+		if got := h.transferCap(int64(tt.sizeMB) * 1024 * 1024); got != tt.want {
+			t.Errorf("transferCap(%d MB) = %s, want %s", tt.sizeMB, got, tt.want)
+		}
+	}
+
+	h.cfg.MaxTransferDuration = 0
+	if got := h.transferCap(1000 * 1024 * 1024); got != 0 {
+		t.Errorf("transferCap with no cap = %s, want 0", got)
+	}
+}
+
+// slowDiscardWriter throws a response away after stalling its first write for delay. Like a real
+// connection, its writes fail once a deadline set through http.ResponseController has passed.
+type slowDiscardWriter struct {
+	header  http.Header
+	delay   time.Duration
+	started bool
+
+	mu       sync.Mutex // Guards deadline, which capTransfer moves from its own goroutine
+	deadline time.Time
+}
+
+func (sw *slowDiscardWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *slowDiscardWriter) WriteHeader(int) {}
+
+func (sw *slowDiscardWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.started = true
+		time.Sleep(sw.delay)
+	}
+	sw.mu.Lock()
+	deadline := sw.deadline
+	sw.mu.Unlock()
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return len(p), nil
+}
+
+func (sw *slowDiscardWriter) SetWriteDeadline(deadline time.Time) error {
+	sw.mu.Lock()
+	sw.deadline = deadline
+	sw.mu.Unlock()
+	return nil
+}
+
+// TestSparseDownloadOutlastsTransferCap downloads a sparse size more slowly than
+// MaxTransferDuration allows, but well above MinBandwidthMbps, and with no bandwidth floor at all
+func TestSparseDownloadOutlastsTransferCap(t *testing.T) {
+	for _, minMbps := range []float64{1, 0} {
+		h := newTestHandler(t)
+		h.cfg.RateLimitPerMB = 0
+		h.cfg.MinBandwidthMbps = minMbps
+		h.cfg.MaxTransferDuration = 20 * time.Millisecond
+
+		req := httptest.NewRequest(http.MethodPost, "/download/init", strings.NewReader(`{"size_mb":2000,"generation":"zero"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.InitDownload(rec, req)
+		var sess DownloadInitResponse
+		if err := json.NewDecoder(rec.Body).Decode(&sess); err != nil || sess.SessionID == "" {
+			t.Fatalf("init: status %d: %v", rec.Code, err)
+		}
+
+		w := &slowDiscardWriter{header: make(http.Header), delay: 100 * time.Millisecond}
+		h.DownloadData(w, httptest.NewRequest(http.MethodGet, "/download/data?session_id="+sess.SessionID, nil))
+
+		h.mu.Lock()
+		status, sent := h.sessions[sess.SessionID].DownloadStatus, h.sessions[sess.SessionID].BytesTransferred
+		h.mu.Unlock()
+		if status != DownloadComplete || sent != sess.Size {
+			t.Errorf("min_bandwidth_mbps %g: download %s after %d of %d bytes, want complete", minMbps, status, sent, sess.Size)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"runtime"
+)
+
+type DebugStatusResponse struct {
+	ActiveSessions   int    `json:"active_sessions"`
+	RateLimitEntries int    `json:"rate_limit_entries"`
+	DataDirBytes     int64  `json:"data_dir_bytes"` // Summed over all data directories
+	Goroutines       int    `json:"goroutines"`
+	HeapAllocBytes   uint64 `json:"heap_alloc_bytes"`
+}
+
+// DebugStatus reports session, disk and runtime figures for diagnosing leaks without a profiler.
+// It is only routed when debugging is enabled in config.
+func (h *DownloadHandler) DebugStatus(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	resp := DebugStatusResponse{
+		ActiveSessions:   len(h.sessions),
+		RateLimitEntries: len(h.rateLimitTAT),
+	}
+	h.mu.Unlock()
+
+	for _, dir := range h.dataDirs {
+		resp.DataDirBytes += dirSize(dir)
+	}
+	resp.Goroutines = runtime.NumGoroutine()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	resp.HeapAllocBytes = mem.HeapAlloc
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// dirSize sums the sizes of all regular files under dir, skipping anything it can't read
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// checkDiskless refuses init options that need a file on disk when the server runs diskless. It
+// writes the error response itself and returns false when the request should not go ahead.
+func (h *DownloadHandler) checkDiskless(w http.ResponseWriter, req DownloadInitRequest) bool {
+	if !h.cfg.Diskless {
+		return true
+	}
+	var option string
+	switch {
+	case req.Compressible:
+		option = "compressible"
+	case req.Seed != nil:
+		option = "seed"
+	case !isRandomGeneration(req.Generation):
+		option = "generation " + req.Generation
+	default:
+		return true
+	}
+	writeJSONError(w, http.StatusBadRequest, CodeUnsupported, option+" is not supported by a diskless server")
+	return false
+}
+
+// streamDiskless serves a session of a diskless server: FileSize bytes straight from crypto/rand,
+// hashed on the way out. As with timed sessions, the hash is stored as the session's expected hash
+// once the download completes, so the client can still verify what it received. Every download of
+// the session sends different data, and ranges are ignored. accepted is as for streamForDuration.
+func (h *DownloadHandler) streamDiskless(w http.ResponseWriter, r *http.Request, sessionID string, sess *Session, dt *duplexTest, accepted time.Time) {
+	setPayloadHeaders(w.Header())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	h.setResponseHeaders(w.Header())
+	hashTrailer := wantsHashTrailer(r)
+	trailers := wantsTrailers(r) || hashTrailer
+	if trailers {
+		declareResultTrailers(w.Header())
+	}
+	if hashTrailer {
+		declareHashTrailer(w.Header())
+	}
+	// As in DownloadData, HTTP/1.1 only carries trailers on chunked responses
+	if !trailers || r.ProtoMajor >= 2 {
+		w.Header().Set("Content-Length", strconv.FormatInt(sess.FileSize, 10))
+	}
+	setTransferDeadline(w, h.transferTimeAllowed(sess.FileSize))
+
+	out := h.throttle(w, r)
+	if dt != nil {
+		out = &progressWriter{ResponseWriter: out, n: &dt.down}
+	}
+	cw := &countingWriter{ResponseWriter: out}
+	hasher := sha256.New()
+
+	// Start tracking time
+	startTime := time.Now()
+
+	_, err := io.CopyBuffer(io.MultiWriter(cw, hasher), io.LimitReader(rand.Reader, sess.FileSize), make([]byte, h.cfg.GenerateBufferKB*1024))
+
+	// End tracking time
+	elapsed := time.Since(startTime)
+
+	if dt != nil {
+		h.finishDuplex(sess, dt, err == nil)
+	}
+	h.recordBytesSent(getClientIP(r), cw.written)
+
+	if err != nil {
+		outcome := downloadOutcome(r, err)
+		h.mu.Lock()
+		sess.BytesTransferred = cw.written
+		sess.DownloadSpeedMbps = 0
+		sess.DownloadStatus = outcome
+		h.mu.Unlock()
+		h.recordDownloadOutcome(outcome)
+
+		log.Printf("Diskless download for session %s %s after %d bytes: %v", sessionID, outcome, cw.written, err)
+		return
+	}
+
+	speedMbps := computeSpeedMbps(cw.written, elapsed)
+	traceTransfer(r.Context(), cw.written, speedMbps)
+	expectedHash := hex.EncodeToString(hasher.Sum(nil))
+	tcpInfo := requestTCPInfo(r)
+
+	h.mu.Lock()
+	sess.ExpectedHash = expectedHash
+	sess.BytesTransferred = cw.written
+	sess.DownloadSpeedMbps = speedMbps
+	sess.DownloadProto = r.Proto
+	sess.DownloadStatus = DownloadComplete
+	sess.TCPInfo = tcpInfo
+	sess.TTFB = cw.firstWrite.Sub(accepted)
+	recordStream(sess, cw.written, speedMbps)
+	h.mu.Unlock()
+	h.recordDownloadOutcome(DownloadComplete)
+
+	if trailers {
+		setResultTrailers(w.Header(), speedMbps, cw.written)
+	}
+	if hashTrailer {
+		w.Header().Set(TrailerSHA256, expectedHash)
+	}
+
+	log.Printf("Diskless download for session %s: %d bytes in %s, %.2f Mbps over %s", sessionID, cw.written, elapsed, speedMbps, r.Proto)
+}
@@ -1,20 +1,44 @@
 package handlers
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/oschwald/geoip2-golang"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// Download states reported by GetSpeed
+const (
+	DownloadPending    = "pending"    // No download has finished yet
+	DownloadComplete   = "complete"   // The last download was fully written
+	DownloadIncomplete = "incomplete" // The last download was cut short; no speed was recorded
+	DownloadCancelled  = "cancelled"  // The client went away during the last download; no speed was recorded
 )
 
 // Possible file sizes in bytes
@@ -29,6 +53,19 @@ var allowedSizes = map[int]int64{
 	1000: 1000 * 1024 * 1024,
 }
 
+// StatusClientClosedRequest is the non-standard status (popularised by nginx) recorded when the
+// client goes away before the server could respond
+const StatusClientClosedRequest = 499
+
+// Supported hash algorithms, keyed by the name reported to clients. Sessions are issued with a
+// sha256 expected_hash; the others can be checked through computed_hashes on verify.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
 // Session stores information about a particular test session
 type Session struct {
 	FilePath          string
@@ -36,125 +73,598 @@ type Session struct {
 	HashAlgorithm     string
 	FileSize          int64
 	CreatedAt         time.Time
+	LastSeen          time.Time // Creation or last keepalive; the session expires SessionTTL after it
+	Keepalives        int       // Keepalives used so far, at most maxKeepalives
 	DownloadSpeedMbps float64
+	DownloadStatus    string        // DownloadComplete, DownloadIncomplete or DownloadCancelled once a download has run
+	DownloadProto     string        // Protocol the download was served over, e.g. "HTTP/2.0"
+	BytesTransferred  int64         // Bytes written by the last download
+	CompressionRatio  float64       // Payload over wire bytes when the last download was gzipped, else 0
+	BlockHashes       []string      // Per-block hashes of the file, computed on the first GetBlockHashes
+	Duration          time.Duration // Non-zero for timed sessions, which stream instead of serving FilePath
+	Tags              map[string]string
+	ClientIP          string // Client that created the session
+	Country           string // ISO code of ClientIP's country, looked up at creation for the results
+	City              string
+	UploadBytes       int64
+	UploadSpeedMbps   float64
+	PingSamples       []float64 // Server-measured round trips in milliseconds, taken while idle
+	LoadedPingSamples []float64 // Round trips measured while a download was running on the session
+	lastPingAt        time.Time
+	Compressible      *CompressiblePayload // Second, compressible file when initialised with compressible
+	Seed              *int64               // Explicit seed the data is generated from; nil for a random one
+	Generation        string               // How the file's content was generated; empty for random
+	TCPInfo           *TCPInfo             // Kernel TCP figures after the last complete download, when available
+	TTFB              time.Duration        // From accepting the last complete download to starting its body
+	Diskless          bool                 // Streamed from crypto/rand without a file; ExpectedHash is set by the last complete download
+	Duplex            *DuplexResult        // Result of the last duplex test
+	Streams           []StreamResult       // Complete downloads of the latest round of parallel downloads
+	FullTestPhase     string               // Phase reached by a full test; empty for other sessions
+	activeDownloads   int                  // DownloadData calls currently serving this session
+	downloads         int                  // DownloadData calls this session has accepted in total
+	shared            *sharedFile          // Set when FilePath is a shared file rather than the session's own
+	duplex            *duplexTest          // The duplex test being set up or run, if any
 }
 
 type DownloadHandler struct {
-	sessions      map[string]*Session
-	mu            sync.Mutex
-	lastAccessMap map[string]time.Time // Map to track last access time per device
+	cfg          Config
+	dataDirs     []string      // The directories of cfg.DataDir; pooled files live in the first
+	nextDataDir  atomic.Uint64 // Round-robin position for placing new files across dataDirs
+	pool         *filePool     // nil when pooling is disabled
+	sessions     map[string]*Session
+	mu           sync.Mutex
+	rateLimitTAT map[string]time.Time // Per-IP time at which the rate limiter allowance is paid off
+
+	// Cumulative counters for /stats. They are bumped by every download, so they are atomic rather
+	// than guarded by mu, which would serialize concurrent downloads on it.
+	totalBytesSent   atomic.Int64             // Bytes written to clients across all sessions
+	bytesSentByIP    sync.Map                 // Client IP to the *ipBytesSent of bytes written to it
+	downloadOutcomes map[string]*atomic.Int64 // Finished downloads (including raw ones) by DownloadStatus; never written after creation
+	sessionsCreated  atomic.Int64             // Sessions registered since startup
+	statsClock       atomic.Int64             // Unix seconds as of the last cleanup tick; a cheap clock for bytesSentByIP
+
+	idempotencyKeys map[string]*idempotencyEntry // Idempotency-Key (scoped by IP) to the session it created
+	results         *resultBuffer                // Recent verification outcomes
+	sharedFiles     map[int64]*sharedFile        // Shared backing file per size, when ShareFiles is on
+	expiredSessions map[string]time.Time         // Tombstones of expired sessions, by when they were cleaned up
+	geo             *geoip2.Reader               // nil unless a GeoIP database is configured and readable
+	hostnames       map[string]hostnameEntry     // Cached reverse DNS names by client IP, when ReverseDNS is on
+	seededHashes    map[seededKey]seededHash     // Cached hashes of seeded content
+	fixtures        map[string]fixture           // Fixtures by name, loaded once from FixtureDir
+	generationSlots chan struct{}                // Semaphore bounding concurrent generations; nil when unlimited
+	hashSlots       chan struct{}                // Semaphore bounding concurrent rehashing of files; nil when unlimited
+	generations     singleflight.Group           // In-progress generations by size, when CoalesceInits is on
+	bandwidth       *bandwidthBucket             // Shared budget of all download responses; nil when uncapped
+
+	orphanCandidates map[string]bool // Unreferenced files seen by the last sweep; only used by the cleanup goroutine
 }
 
-func NewDownloadHandler() *DownloadHandler {
+func NewDownloadHandler(cfg Config) *DownloadHandler {
 	handler := &DownloadHandler{
-		sessions:      make(map[string]*Session),
-		lastAccessMap: make(map[string]time.Time),
+		cfg:              cfg,
+		dataDirs:         cfg.dataDirs(),
+		sessions:         make(map[string]*Session),
+		rateLimitTAT:     make(map[string]time.Time),
+		downloadOutcomes: newOutcomeCounters(),
+
+		idempotencyKeys: make(map[string]*idempotencyEntry),
+		results:         newResultBuffer(cfg.MaxResults),
+		sharedFiles:     make(map[int64]*sharedFile),
+		expiredSessions: make(map[string]time.Time),
+		geo:             openGeoIP(cfg.GeoIPDB),
+		hostnames:       make(map[string]hostnameEntry),
+		seededHashes:    make(map[seededKey]seededHash),
+		fixtures:        loadFixtures(cfg.FixtureDir, cfg.HashBufferKB*1024),
+	}
+	handler.statsClock.Store(time.Now().Unix())
+	if cfg.MaxGenerations > 0 {
+		handler.generationSlots = make(chan struct{}, cfg.MaxGenerations)
+	}
+	if cfg.MaxHashers > 0 {
+		handler.hashSlots = make(chan struct{}, cfg.MaxHashers)
+	}
+	if cfg.MaxTotalMbps > 0 {
+		handler.bandwidth = newBandwidthBucket(cfg.MaxTotalMbps)
+	}
+	if cfg.MaxLoadAverage > 0 {
+		if _, err := readLoadAverage(); err != nil {
+			log.Printf("Load backpressure disabled: %v", err)
+			handler.cfg.MaxLoadAverage = 0
+		}
+	}
+	if !cfg.Diskless {
+		for _, dir := range handler.dataDirs {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				log.Printf("Error creating data directory %s: %v", dir, err)
+			}
+		}
+		// Nothing can reference files from before a restart
+		handler.sweepOrphanedFiles(true)
+	}
+	if cfg.PoolSize > 0 {
+		handler.pool = newFilePool(handler, cfg.PoolSize)
+		handler.pool.start()
 	}
 	handler.StartCleanup()
 	return handler
 }
 
+// getClientIP returns the client address stored by the ClientIP middleware, or the connection's
+// remote address for requests that didn't pass through it
 func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		ips := strings.Split(forwarded, ",")
-		return strings.TrimSpace(ips[0]) // Return the first IP in the list
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return resolveClientIP(r, 0)
+}
+
+// resolveClientIP picks the client's address out of X-Forwarded-For, trusting the given number of
+// proxies (see ClientIP). Without trusted proxies, or when the chain is shorter than the proxies
+// would have made it, the header may be entirely the client's own, so the connection's remote
+// address is used instead.
+func resolveClientIP(r *http.Request, trustedProxies int) string {
+	if trustedProxies > 0 {
+		// Proxies may also send the header as several lines
+		forwarded := r.Header.Values("X-Forwarded-For")
+		ips := strings.Split(strings.Join(forwarded, ","), ",")
+		if len(forwarded) > 0 && trustedProxies <= len(ips) {
+			return strings.TrimSpace(ips[len(ips)-trustedProxies])
+		}
 	}
+	return remoteIP(r.RemoteAddr)
+}
 
-	// Fallback to RemoteAddr
-	remoteAddr := r.RemoteAddr
-	if colonIndex := strings.LastIndex(remoteAddr, ":"); colonIndex != -1 {
-		return remoteAddr[:colonIndex] // Strip port if present
+// remoteIP strips the port, and the brackets of an IPv6 address, from a connection's remote
+// address. Addresses without a port, such as those of Unix socket peers, are returned as they are.
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
 	}
+	return remoteAddr
+}
 
-	return remoteAddr // Return as-is if no port
+// RateLimitedResponse is the body of a 429 from the rate limiter. RetryAfterSec matches the
+// Retry-After header.
+type RateLimitedResponse struct {
+	Error         string    `json:"error"`
+	Code          ErrorCode `json:"code"`
+	RetryAfterSec int       `json:"retry_after_sec"`
 }
 
-func (h *DownloadHandler) CheckRateLimit(r *http.Request) bool {
+// checkRateLimit refuses with 429 when the client is over its rate limit, telling it in Retry-After
+// and the body when it may try again, so retries spread out instead of hammering the server. It
+// writes the error response itself and returns false when the request should not go ahead.
+func (h *DownloadHandler) checkRateLimit(w http.ResponseWriter, r *http.Request, costMB int) bool {
+	wait, ok := h.CheckRateLimit(r, costMB)
+	if ok {
+		return true
+	}
+
+	// Round up, so a client that waits exactly this long is let through
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(RateLimitedResponse{
+		Error:         "Rate limit exceeded. Try again later.",
+		Code:          CodeRateLimited,
+		RetryAfterSec: retryAfter,
+	})
+	return false
+}
+
+// CheckRateLimit charges an init costing costMB against the client's allowance and reports whether
+// it may proceed, and if not, how long until it may. Each MB costs cfg.RateLimitPerMB of waiting,
+// and a client may run up to cfg.RateLimitBurst ahead, so small tests can be repeated often while
+// large ones are throttled sooner. This is a GCRA: the state per IP is the time at which its spent
+// allowance is paid off. Requests carrying the bypass token are always let through.
+func (h *DownloadHandler) CheckRateLimit(r *http.Request, costMB int) (time.Duration, bool) {
+	if h.cfg.RateLimitPerMB <= 0 {
+		return 0, true
+	}
+
 	clientIP := getClientIP(r)
+	if h.hasBypassToken(r) {
+		log.Printf("Rate limit bypassed by token for IP: %s (cost %d MB)", clientIP, costMB)
+		return 0, true
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	lastAccess, exists := h.lastAccessMap[clientIP]
-	if exists && time.Since(lastAccess) < 10*time.Second {
+	now := time.Now()
+	tat := h.rateLimitTAT[clientIP]
+	if tat.Before(now) {
+		tat = now
+	}
+	if ahead := tat.Sub(now); ahead > h.cfg.RateLimitBurst {
 		log.Printf("Rate limit exceeded for IP: %s", clientIP)
-		return false // Deny access
+		return ahead - h.cfg.RateLimitBurst, false // Deny access
+	}
+
+	h.rateLimitTAT[clientIP] = tat.Add(time.Duration(costMB) * h.cfg.RateLimitPerMB)
+	log.Printf("Access granted for IP: %s (cost %d MB)", clientIP, costMB)
+	return 0, true // Allow access
+}
+
+// BypassTokenHeader carries the token that exempts trusted clients, such as synthetic monitors,
+// from the rate limit
+const BypassTokenHeader = "X-Bypass-Token"
+
+// hasBypassToken reports whether r presents the configured rate limit bypass token. The token is
+// compared in constant time.
+func (h *DownloadHandler) hasBypassToken(r *http.Request) bool {
+	if h.cfg.RateLimitBypassToken == "" {
+		return false
+	}
+	token := r.Header.Get(BypassTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.RateLimitBypassToken)) == 1
+}
+
+// initCostMB is what an init request is charged by the rate limiter. Timed sessions send an
+// unbounded amount of data and sparse sizes cost nothing to generate, so both are charged like the
+// largest allowed size.
+func initCostMB(req DownloadInitRequest) int {
+	_, sparse := sparseSizes[req.SizeMB]
+	if req.DurationSec != 0 || sparse {
+		sizes := sortedSizesMB()
+		return sizes[len(sizes)-1]
+	}
+	if _, ok := allowedSizes[req.SizeMB]; ok {
+		if req.Compressible {
+			return 2 * req.SizeMB // Two files are generated
+		}
+		return req.SizeMB
 	}
+	return 0 // Rejected further on anyway
+}
 
-	// Update access time
-	h.lastAccessMap[clientIP] = time.Now()
-	log.Printf("Access granted for IP: %s. Updated lastAccessMap: %+v", clientIP, h.lastAccessMap)
-	return true // Allow access
+// evictRateLimits forgets clients whose allowance is fully restored. The caller must hold h.mu.
+func (h *DownloadHandler) evictRateLimits(now time.Time) {
+	for clientIP, tat := range h.rateLimitTAT {
+		if tat.Before(now) {
+			delete(h.rateLimitTAT, clientIP)
+		}
+	}
 }
 
 type DownloadInitRequest struct {
-	SizeMB int `json:"size_mb"`
+	SizeMB      int               `json:"size_mb"`
+	DurationSec int               `json:"duration_sec,omitempty"` // Stream for this long instead of serving size_mb
+	Tags        map[string]string `json:"tags,omitempty"`         // Client labels echoed back with results
+	DryRun      bool              `json:"dry_run,omitempty"`      // Only report the expected hash; create nothing
+	// Also generate a compressible payload, served with payload=compressible
+	Compressible bool `json:"compressible,omitempty"`
+	// Generate the data from this seed, so the same seed and size always give the same bytes and hash
+	Seed *int64 `json:"seed,omitempty"`
+	// Content of the file: random (the default), zero or compressible
+	Generation string `json:"generation,omitempty"`
+
+	fullTest bool // Set by InitFullTest, so the session starts out in PhasePending
 }
 
 type DownloadInitResponse struct {
-	SessionID     string `json:"session_id"`
-	Size          int64  `json:"size"`
-	HashAlgorithm string `json:"hash_algorithm"`
-	ExpectedHash  string `json:"expected_hash"`
+	SessionID     string     `json:"session_id"`
+	Size          int64      `json:"size"`
+	HashAlgorithm string     `json:"hash_algorithm"`
+	ExpectedHash  string     `json:"expected_hash"`
+	DurationSec   int        `json:"duration_sec,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"` // After this the session answers 410 Gone; unset for dry runs
+	DryRun        bool       `json:"dry_run,omitempty"`
+	// SHA-256 of the compressible payload, when initialised with compressible
+	CompressibleHash string `json:"compressible_hash,omitempty"`
+	// Content of the file, unless it is random
+	Generation string `json:"generation,omitempty"`
+	// Parallel connections suggested for downloading this session, from its size and max_connections
+	RecommendedConnections int `json:"recommended_connections"`
+}
+
+// createSession prepares a test file of sess.FileSize bytes and registers sess for it. A file from
+// the pre-generated pool is used when one is available. Otherwise generation is abandoned, and the
+// partial file removed, if ctx is cancelled. Seeded sessions and those with other than random
+// content always get a file of their own.
+func (h *DownloadHandler) createSession(ctx context.Context, sess *Session) (string, error) {
+	sessionID := uuid.New().String()
+
+	if h.cfg.Diskless {
+		sess.Diskless = true
+		h.registerSession(sessionID, sess)
+		return sessionID, nil
+	}
+
+	if sess.Seed != nil || !isRandomGeneration(sess.Generation) {
+		filePath, err := h.dataPath(h.pickDataDir(), sessionID+".bin")
+		if err != nil {
+			return "", err
+		}
+		if sess.ExpectedHash, err = h.prepareFile(ctx, filePath, sess.FileSize, sess.Seed, sess.Generation); err != nil {
+			return "", err
+		}
+		sess.FilePath = filePath
+		h.registerSession(sessionID, sess)
+		return sessionID, nil
+	}
+
+	if h.cfg.ShareFiles {
+		sf, err := h.acquireSharedFile(ctx, sess.FileSize)
+		if err != nil {
+			return "", err
+		}
+		sess.FilePath = sf.path
+		sess.ExpectedHash = sf.hash
+		sess.shared = sf
+		h.registerSession(sessionID, sess)
+		return sessionID, nil
+	}
+
+	// A pooled file is renamed into place, which only works within the directory of the pool
+	filePath, err := h.dataPath(h.dataDirs[0], sessionID+".bin")
+	if err != nil {
+		return "", err
+	}
+	expectedHash, ok := h.pool.take(sess.FileSize, filePath)
+	switch {
+	case ok:
+	case h.cfg.CoalesceInits:
+		// Coalesced files are linked to each other, so they too stay in the first directory
+		if expectedHash, err = h.prepareCoalesced(ctx, filePath, sess.FileSize); err != nil {
+			return "", err
+		}
+	default:
+		if filePath, err = h.dataPath(h.pickDataDir(), sessionID+".bin"); err != nil {
+			return "", err
+		}
+		if expectedHash, err = h.prepareFile(ctx, filePath, sess.FileSize, nil, GenerationRandom); err != nil {
+			return "", err
+		}
+	}
+
+	sess.FilePath = filePath
+	sess.ExpectedHash = expectedHash
+	h.registerSession(sessionID, sess)
+
+	return sessionID, nil
+}
+
+// registerSession stamps sess with its creation time and makes it visible under sessionID
+func (h *DownloadHandler) registerSession(sessionID string, sess *Session) {
+	sess.CreatedAt = time.Now()
+	sess.LastSeen = sess.CreatedAt
+	// Looked up here, before taking h.mu, rather than when results are recorded under it
+	sess.Country, sess.City = h.locate(sess.ClientIP)
+
+	h.mu.Lock()
+	h.sessions[sessionID] = sess
+	h.mu.Unlock()
+	h.sessionsCreated.Add(1)
+
+	// By the time the session has results, the client's hostname will usually be known
+	h.resolveHostname(sess.ClientIP)
+}
+
+// initSession checks the host's load and session capacity, rate limits the client, validates an init
+// request and creates its session. On failure it writes the error response itself and returns false.
+func (h *DownloadHandler) initSession(w http.ResponseWriter, r *http.Request, req DownloadInitRequest) (string, *Session, bool) {
+	if !h.checkLoad(w) {
+		return "", nil, false
+	}
+	if !h.checkCapacity(w, 1) {
+		return "", nil, false
+	}
+	if !h.checkRateLimit(w, r, initCostMB(req)) {
+		return "", nil, false
+	}
+
+	if err := validateTags(req.Tags); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidTags, "Invalid tags: "+err.Error())
+		return "", nil, false
+	}
+	if err := validateGeneration(req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return "", nil, false
+	}
+	if !h.checkDiskless(w, req) {
+		return "", nil, false
+	}
+
+	sess := &Session{
+		HashAlgorithm: "sha256",
+		ClientIP:      getClientIP(r),
+		Tags:          req.Tags,
+		Seed:          req.Seed,
+	}
+	if req.fullTest {
+		sess.FullTestPhase = PhasePending
+	}
+	if !isRandomGeneration(req.Generation) {
+		sess.Generation = req.Generation
+	}
+
+	if req.DurationSec != 0 {
+		return h.initTimedSession(w, req, sess)
+	}
+
+	size, ok := h.requestedSize(req)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidSize, invalidSizeMessage())
+		return "", nil, false
+	}
+	sess.FileSize = size
+	if _, sparse := sparseSizes[req.SizeMB]; !sparse {
+		// Sparse sizes keep their exact length, whose hash is known in advance
+		sess.FileSize = h.jitterSize(size, req.Seed)
+	}
+
+	if req.Compressible {
+		payload, err := h.prepareCompressibleFile(r.Context(), sess.FileSize, req.Seed)
+		if err != nil {
+			writeCreateError(w, err, size)
+			return "", nil, false
+		}
+		sess.Compressible = payload
+	}
+
+	sessionID, err := h.createSession(r.Context(), sess)
+	if err != nil {
+		if sess.Compressible != nil {
+			os.Remove(sess.Compressible.FilePath)
+		}
+		writeCreateError(w, err, sess.FileSize)
+		return "", nil, false
+	}
+	return sessionID, sess, true
+}
+
+// writeCreateError writes the response for a failure to generate the files of a session of size bytes
+func writeCreateError(w http.ResponseWriter, err error, size int64) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// Nobody is listening any more, but record the outcome for logs and proxies
+		log.Printf("Client closed request during init for %d bytes", size)
+		w.WriteHeader(StatusClientClosedRequest)
+	case errors.Is(err, errGenerationBusy):
+		writeJSONError(w, http.StatusServiceUnavailable, CodeServerBusy, "Too many test files are being generated. Try again later.")
+	default:
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+	}
+}
+
+// newInitResponse describes a newly registered session. It takes h.mu, since the session is live and
+// other requests may already be touching it.
+func (h *DownloadHandler) newInitResponse(sessionID string, sess *Session) DownloadInitResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	expiresAt := h.sessionExpiry(sess)
+	resp := DownloadInitResponse{
+		SessionID:     sessionID,
+		Size:          sess.FileSize,
+		HashAlgorithm: sess.HashAlgorithm,
+		ExpectedHash:  sess.ExpectedHash,
+		DurationSec:   int(sess.Duration / time.Second),
+		ExpiresAt:     &expiresAt,
+	}
+	if sess.Compressible != nil {
+		resp.CompressibleHash = sess.Compressible.ExpectedHash
+	}
+	resp.Generation = sess.Generation
+	resp.RecommendedConnections = h.recommendedConnections(sess.FileSize, sess.Duration > 0)
+	if sess.Diskless {
+		resp.RecommendedConnections = 1 // A stream can't be split into ranges
+	}
+	return resp
+}
+
+// prepareFile generates a file of the given generation mode at path from seed (a random one when
+// nil) and returns its SHA-256 hash, once a generation slot is free. The file is removed again if
+// anything fails.
+func (h *DownloadHandler) prepareFile(ctx context.Context, path string, size int64, seed *int64, generation string) (string, error) {
+	ctx, span := startSpan(ctx, "generate",
+		attribute.Int64("speedtest.size_bytes", size),
+		attribute.String("speedtest.generation", generation),
+	)
+	release, err := h.acquireGenerationSlot(ctx)
+	if err != nil {
+		endSpan(span, err)
+		return "", err
+	}
+	defer release()
+	span.AddEvent("generation slot acquired")
+
+	// Generate a temporary file, hashing it as it is written
+	var expectedHash string
+	if isRandomGeneration(generation) && seed == nil {
+		expectedHash, err = h.generateRandomFile(ctx, path, size)
+	} else {
+		expectedHash, err = h.generateFile(ctx, path, generation, size, seed)
+	}
+	endSpan(span, err)
+	if err != nil {
+		log.Printf("Error generating file: %v", err)
+		os.Remove(path)
+		return "", err
+	}
+	return expectedHash, nil
 }
 
 // InitDownload creates a temp file of requested size, computes its hash, and returns session info
 func (h *DownloadHandler) InitDownload(w http.ResponseWriter, r *http.Request) {
-	if !h.CheckRateLimit(r) {
-		http.Error(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
+	var req DownloadInitRequest
+	if !decodeJSONBody(w, r, &req, maxInitBodyBytes) {
 		return
 	}
+
+	h.initDownload(w, r, req)
+}
+
+// InitDownloadQuery is the GET variant of InitDownload for clients that can't easily POST JSON.
+// The request fields are taken from query parameters of the same name.
+func (h *DownloadHandler) InitDownloadQuery(w http.ResponseWriter, r *http.Request) {
 	var req DownloadInitRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	var err error
+	if req.SizeMB, err = queryInt(r, "size_mb"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "size_mb must be an integer")
 		return
 	}
-
-	size, ok := allowedSizes[req.SizeMB]
-	if !ok {
-		http.Error(w, "Invalid size requested. Allowed values: 5,10,20,50,100", http.StatusBadRequest)
+	if req.DurationSec, err = queryInt(r, "duration_sec"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "duration_sec must be an integer")
 		return
 	}
+	req.DryRun = r.URL.Query().Get("dry_run") == "true"
+	req.Compressible = r.URL.Query().Get("compressible") == "true"
+	req.Generation = r.URL.Query().Get("generation")
+	if value := r.URL.Query().Get("seed"); value != "" {
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "seed must be a 64-bit integer")
+			return
+		}
+		req.Seed = &seed
+	}
 
-	sessionID := uuid.New().String()
+	h.initDownload(w, r, req)
+}
 
-	// Generate a temporary file
-	filePath := filepath.Join("tmpdata", sessionID+".bin")
-	if err := h.generateRandomFile(filePath, size); err != nil {
-		log.Printf("Error generating file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+// queryInt parses an optional integer query parameter, returning 0 when it is absent
+func queryInt(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// initDownload is the implementation shared by both InitDownload variants
+func (h *DownloadHandler) initDownload(w http.ResponseWriter, r *http.Request, req DownloadInitRequest) {
+	h.simulateDelay(r)
+
+	if req.DryRun {
+		h.dryRunInit(w, r, req)
 		return
 	}
 
-	// Compute SHA-256 hash of the file
-	expectedHash, err := computeFileHash(filePath)
+	// A retried request gets the session it already created, without counting against the rate limit
+	sessionID, sess, finish, err := h.claimIdempotent(r)
 	if err != nil {
-		log.Printf("Error hashing file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Client closed request while waiting for an init with the same %s", IdempotencyKeyHeader)
+		w.WriteHeader(StatusClientClosedRequest)
 		return
 	}
-
-	h.mu.Lock()
-	h.sessions[sessionID] = &Session{
-		FilePath:      filePath,
-		ExpectedHash:  expectedHash,
-		HashAlgorithm: "sha256",
-		FileSize:      size,
-		CreatedAt:     time.Now(),
+	if sess == nil {
+		var ok bool
+		if sessionID, sess, ok = h.initSession(w, r, req); !ok {
+			finish("")
+			return
+		}
+		finish(sessionID)
 	}
-	h.mu.Unlock()
 
-	resp := DownloadInitResponse{
-		SessionID:     sessionID,
-		Size:          size,
-		HashAlgorithm: "sha256",
-		ExpectedHash:  expectedHash,
-	}
+	resp := h.newInitResponse(sessionID, sess)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("Error encoding init response: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 }
@@ -162,154 +672,592 @@ func (h *DownloadHandler) InitDownload(w http.ResponseWriter, r *http.Request) {
 func (h *DownloadHandler) DownloadData(w http.ResponseWriter, r *http.Request) {
 	sessionID := r.URL.Query().Get("session_id")
 	if sessionID == "" {
-		http.Error(w, "session_id is required", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, CodeSessionIDRequired, "session_id is required")
 		return
 	}
 
 	h.mu.Lock()
-	sess, exists := h.sessions[sessionID]
+	sess, status := h.findSession(sessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
+		return
+	}
+	compressible := sess.Compressible // Cleared under h.mu when the session's files are removed
+	if r.Method == http.MethodHead {
+		h.mu.Unlock()
+		h.headData(w, r, sess, compressible)
+		return
+	}
+	if sess.activeDownloads >= h.cfg.MaxConnections {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusTooManyRequests, CodeTooManyConnections, "Too many concurrent downloads for this session")
+		return
+	}
+	if msg := enterPhase(sess, PhaseDownload); msg != "" {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, CodePhaseOutOfOrder, msg)
+		return
+	}
+	if h.cfg.MaxDownloadsPerSession > 0 && sess.downloads >= h.cfg.MaxDownloadsPerSession {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusGone, CodeSessionConsumed, fmt.Sprintf("Session has already been downloaded %d times", sess.downloads))
+		return
+	}
+	startStreams(sess)
+	sess.activeDownloads++
+	sess.downloads++
 	h.mu.Unlock()
 
-	if !exists {
-		http.Error(w, "Invalid session_id", http.StatusNotFound)
+	defer func() {
+		h.mu.Lock()
+		sess.activeDownloads--
+		h.mu.Unlock()
+	}()
+
+	r, endTransfer := h.capTransfer(w, r, sess.FileSize, "Download for session "+sessionID)
+	defer endTransfer()
+
+	payload, ok := parsePayload(w, r, compressible)
+	if !ok {
+		return
+	}
+
+	var dt *duplexTest
+	if wantsDuplex(r) {
+		if dt, ok = h.joinDuplex(w, r, sess, duplexDownload); !ok {
+			return
+		}
+	}
+
+	// Time to first byte is counted from here, so waiting for the other direction of a duplex test
+	// isn't mistaken for setup cost
+	accepted := time.Now()
+
+	if sess.Duration > 0 {
+		h.streamForDuration(w, r, sessionID, sess, accepted)
 		return
 	}
+	if sess.Diskless {
+		h.streamDiskless(w, r, sessionID, sess, dt, accepted)
+		return
+	}
+
+	filePath, expectedHash := sess.FilePath, sess.ExpectedHash
+	if payload != nil {
+		filePath, expectedHash = payload.FilePath, payload.ExpectedHash
+	}
 
-	f, err := os.Open(sess.FilePath)
+	f, err := os.Open(filePath)
 	if err != nil {
 		log.Printf("Error opening file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		if dt != nil {
+			h.finishDuplex(sess, dt, false)
+		}
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
 		return
 	}
 	defer f.Close()
 
+	setTransferDeadline(w, h.transferTimeAllowed(sess.FileSize))
+
 	// Start tracking time
 	startTime := time.Now()
 
-	// Serve the file content
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	http.ServeContent(w, r, filepath.Base(sess.FilePath), time.Now(), f)
+	// Serve the file content, counting what actually reaches the connection
+	out := h.throttle(w, r)
+	if dt != nil {
+		out = &progressWriter{ResponseWriter: out, n: &dt.down}
+	}
+	cw := &countingWriter{ResponseWriter: out}
+	setPayloadHeaders(w.Header())
+	h.setResponseHeaders(w.Header())
+	hashTrailer := wantsHashTrailer(r)
+	trailers := wantsTrailers(r) || hashTrailer
+	if trailers {
+		declareResultTrailers(w.Header())
+	}
+	var body io.ReadSeeker = f
+	var hr *hashingReader
+	if hashTrailer {
+		declareHashTrailer(w.Header())
+		hr = newHashingReader(f)
+		body = hr
+	}
+	compressed := wantsGzip(r)
+	if compressed {
+		serveGzip(cw, body)
+	} else {
+		// ServeContent leaves Content-Length unset once Content-Encoding is present, so provide it.
+		// Range responses (206, with Content-Range) overwrite it with the range length. HTTP/1.1 only
+		// carries trailers on chunked responses, so the length is left out when they were asked for;
+		// range responses always have a length, so they come without trailers on HTTP/1.1.
+		if !trailers || r.ProtoMajor >= 2 {
+			w.Header().Set("Content-Length", strconv.FormatInt(sess.FileSize, 10))
+		}
+		// The ETag also lets ServeContent honour If-Range and If-None-Match. The gzipped
+		// representation differs, so it gets none.
+		w.Header().Set("ETag", payloadETag(expectedHash))
+		http.ServeContent(cw, r, filepath.Base(filePath), time.Now(), body)
+	}
 
 	// End tracking time
 	endTime := time.Now()
 
-	// Calculate download speed
-	duration := endTime.Sub(startTime).Seconds()                         // Time in seconds
-	speedMbps := (float64(sess.FileSize) * 8) / (duration * 1024 * 1024) // Convert bytes to Mbps
+	if dt != nil {
+		h.finishDuplex(sess, dt, cw.err == nil && cw.status < http.StatusMultipleChoices)
+	}
+
+	h.recordBytesSent(getClientIP(r), cw.written)
+
+	if cw.status >= http.StatusMultipleChoices {
+		// Nothing was measured, e.g. 416 for a range outside the file
+		return
+	}
+	if cw.err != nil {
+		// The client went away or the connection broke, so any speed would be meaningless
+		outcome := downloadOutcome(r, cw.err)
+		h.mu.Lock()
+		if payload != nil {
+			payload.BytesTransferred = cw.written
+			payload.DownloadSpeedMbps = 0
+			payload.DownloadStatus = outcome
+		} else {
+			sess.BytesTransferred = cw.written
+			sess.DownloadSpeedMbps = 0
+			sess.DownloadStatus = outcome
+		}
+		h.mu.Unlock()
+		h.recordDownloadOutcome(outcome)
+
+		log.Printf("Download for session %s %s after %d bytes: %v", sessionID, outcome, cw.written, cw.err)
+		return
+	}
+
+	// Calculate download speed from what was served: a range request (206) only sends part of the
+	// file. Gzipped downloads count the payload rather than the compressed bytes on the wire.
+	servedBytes := cw.written
+	if compressed {
+		servedBytes = sess.FileSize
+	}
+	speedMbps := computeSpeedMbps(servedBytes, endTime.Sub(startTime))
+	traceTransfer(r.Context(), servedBytes, speedMbps)
+
+	ratio := 0.0
+	if compressed {
+		ratio = compressionRatio(sess.FileSize, cw.written)
+	}
+
+	tcpInfo := requestTCPInfo(r)
 
 	h.mu.Lock()
-	sess.DownloadSpeedMbps = speedMbps // Store speed in session
+	if payload != nil {
+		payload.BytesTransferred = cw.written
+		payload.DownloadSpeedMbps = speedMbps
+		payload.DownloadStatus = DownloadComplete
+		payload.CompressionRatio = ratio
+	} else {
+		sess.BytesTransferred = cw.written
+		sess.DownloadSpeedMbps = speedMbps // Store speed in session
+		sess.DownloadProto = r.Proto
+		sess.DownloadStatus = DownloadComplete
+		sess.CompressionRatio = ratio
+		sess.TCPInfo = tcpInfo
+		sess.TTFB = cw.firstWrite.Sub(accepted)
+		recordStream(sess, cw.written, speedMbps)
+	}
 	h.mu.Unlock()
+	h.recordDownloadOutcome(DownloadComplete)
 
-	log.Printf("Download speed for session %s: %.2f Mbps", sessionID, speedMbps)
+	if trailers {
+		setResultTrailers(w.Header(), speedMbps, cw.written)
+	}
+	// A multi-range response reads the file once per range, so no single hash describes it
+	if hr != nil && !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/") {
+		w.Header().Set(TrailerSHA256, hr.sum())
+	}
+
+	log.Printf("Download speed for session %s: %.2f Mbps for %d bytes over %s", sessionID, speedMbps, servedBytes, r.Proto)
 }
 
 type DownloadVerifyRequest struct {
-	SessionID    string `json:"session_id"`
-	ComputedHash string `json:"computed_hash"`
+	SessionID      string            `json:"session_id"`
+	ComputedHash   string            `json:"computed_hash"`
+	ComputedHashes map[string]string `json:"computed_hashes,omitempty"` // algorithm -> hash; replaces computed_hash
+	Keep           bool              `json:"keep,omitempty"`            // Keep the file for re-testing instead of deleting it
+	VerifyBytes    int64             `json:"verify_bytes,omitempty"`    // Only the first this many bytes were hashed by the client
+	ReceivedBytes  *int64            `json:"received_bytes,omitempty"`  // How many bytes the client downloaded, checked before any hash
 }
 
 type DownloadVerifyResponse struct {
-	Status string `json:"status"`
+	Status      string          `json:"status"`
+	Results     map[string]bool `json:"results,omitempty"`      // Pass/fail per algorithm for computed_hashes or verify_bytes
+	BytesHashed int64           `json:"bytes_hashed,omitempty"` // How much of the file the server hashed for computed_hashes or verify_bytes
 }
 type SpeedResponse struct {
-	SessionID         string  `json:"session_id"`
-	DownloadSpeedMbps float64 `json:"download_speed_mbps"`
+	SessionID         string            `json:"session_id"`
+	DownloadSpeedMbps float64           `json:"download_speed_mbps"`
+	DownloadSpeed     float64           `json:"download_speed"` // download_speed_mbps converted to unit
+	Unit              string            `json:"unit"`
+	Status            string            `json:"status"`
+	BytesTransferred  int64             `json:"bytes_transferred"`
+	Proto             string            `json:"proto"`
+	CompressionRatio  float64           `json:"compression_ratio,omitempty"` // Set when downloaded with compress=gzip
+	Tags              map[string]string `json:"tags,omitempty"`
+	Hostname          string            `json:"hostname,omitempty"`     // Client's reverse DNS name, when enabled and resolved
+	Unreliable        bool              `json:"unreliable,omitempty"`   // Fewer than MinReliableMB were transferred
+	Compressible      *PayloadSpeed     `json:"compressible,omitempty"` // The compressible payload, when the session has one
+	TCPInfo           *TCPInfo          `json:"tcp_info,omitempty"`     // Kernel TCP figures after the last download; Linux only
+	TTFBMs            float64           `json:"ttfb_ms"`                // Server-side setup time before the first byte of the last download
+	Streams           *StreamStats      `json:"streams,omitempty"`      // Parallel downloads of the latest round, once one has completed
 }
 
+// GetSpeed reports the stored download speed, converted to the unit given by the units query
+// parameter (Mbps, MB/s or Gbps; Mbps by default)
 func (h *DownloadHandler) GetSpeed(w http.ResponseWriter, r *http.Request) {
 	sessionID := r.URL.Query().Get("session_id")
 	if sessionID == "" {
-		http.Error(w, "session_id is required", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, CodeSessionIDRequired, "session_id is required")
 		return
 	}
 
-	h.mu.Lock()
-	sess, exists := h.sessions[sessionID]
-	h.mu.Unlock()
+	unit, ok := parseSpeedUnit(r.URL.Query().Get("units"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "units must be one of Mbps, MB/s, Gbps")
+		return
+	}
 
-	if !exists {
-		http.Error(w, "Invalid session_id", http.StatusNotFound)
+	h.mu.Lock()
+	sess, status := h.findSession(sessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
 		return
 	}
 
 	resp := SpeedResponse{
 		SessionID:         sessionID,
 		DownloadSpeedMbps: sess.DownloadSpeedMbps, // Use stored speed
+		Status:            sess.DownloadStatus,
+		BytesTransferred:  sess.BytesTransferred,
+		Proto:             sess.DownloadProto,
+		CompressionRatio:  sess.CompressionRatio,
+		Tags:              sess.Tags,
+		Hostname:          h.hostname(sess.ClientIP),
+		Unreliable:        h.unreliable(sess),
+		TCPInfo:           sess.TCPInfo,
+		TTFBMs:            float64(sess.TTFB) / float64(time.Millisecond),
+		Streams:           streamStats(sess),
+	}
+	if c := sess.Compressible; c != nil {
+		resp.Compressible = &PayloadSpeed{
+			DownloadSpeedMbps: c.DownloadSpeedMbps,
+			Status:            c.DownloadStatus,
+			BytesTransferred:  c.BytesTransferred,
+			CompressionRatio:  c.CompressionRatio,
+		}
+	}
+	h.mu.Unlock()
+
+	if resp.Status == "" {
+		resp.Status = DownloadPending
 	}
+	if resp.Compressible != nil && resp.Compressible.Status == "" {
+		resp.Compressible.Status = DownloadPending
+	}
+	resp.DownloadSpeed = resp.DownloadSpeedMbps * unit.fromMbps
+	resp.Unit = unit.name
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-// VerifyDownload checks if the computed hash matches the expected hash. If it does, remove the file.
+// VerifyDownload checks if the computed hash matches the expected hash. If it does, remove the file
+// unless the request asks to keep it.
 func (h *DownloadHandler) VerifyDownload(w http.ResponseWriter, r *http.Request) {
 	var req DownloadVerifyRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, "Bad request")
+		return
+	}
+	if req.ReceivedBytes != nil && *req.ReceivedBytes < 0 {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "received_bytes must not be negative")
+		return
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("speedtest.session_id", req.SessionID))
+	if len(req.ComputedHashes) > 0 || req.VerifyBytes != 0 {
+		h.verifyHashes(w, r, req)
 		return
 	}
 
 	h.mu.Lock()
-	sess, exists := h.sessions[req.SessionID]
-	if !exists {
+	sess, status := h.findSession(req.SessionID)
+	if sess == nil {
 		h.mu.Unlock()
-		http.Error(w, "Invalid session_id", http.StatusNotFound)
+		writeSessionError(w, status)
+		return
+	}
+	if msg := receivedBytesMismatch(sess, req.ReceivedBytes); msg != "" {
+		h.recordResult(req.SessionID, sess, ResultSizeMismatch)
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusBadRequest, CodeSizeMismatch, msg)
 		return
 	}
 
 	expectedHash := sess.ExpectedHash
-	filePath := sess.FilePath
 
-	if req.ComputedHash == expectedHash {
-		// Attempt to delete the file
-		if err := os.Remove(filePath); err != nil {
+	// Reject malformed hashes up front so client bugs aren't reported as transfer corruption
+	computedHash := strings.ToLower(req.ComputedHash)
+	if err := validateHashFormat(sess.HashAlgorithm, computedHash); err != nil {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusUnprocessableEntity, CodeMalformedHash, "Malformed computed_hash: "+err.Error())
+		return
+	}
+
+	if hashesEqual(computedHash, expectedHash) {
+		if err := h.completeVerification(req.SessionID, sess, req.Keep); err != nil {
 			log.Printf("Error removing file: %v", err)
-			http.Error(w, "File removal failed", http.StatusInternalServerError)
+			writeJSONError(w, http.StatusInternalServerError, CodeInternal, "File removal failed")
 			h.mu.Unlock()
 			return
 		}
-
-		// Remove session after successful deletion
-		delete(h.sessions, req.SessionID)
 		h.mu.Unlock()
 
 		resp := DownloadVerifyResponse{Status: "success"}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	} else {
+		h.recordResult(req.SessionID, sess, ResultHashMismatch)
+		filePath := sess.FilePath
+		if sess.Duration > 0 || sess.Diskless {
+			filePath = "" // Nothing on disk to rehash
+		}
 		h.mu.Unlock()
-		http.Error(w, "Hash mismatch", http.StatusBadRequest)
+		if h.cfg.Debug && filePath != "" {
+			h.writeHashMismatchDebug(w, r, filePath)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, CodeHashMismatch, "Hash mismatch")
 	}
 }
 
-// generateRandomFile creates a file of the given size filled with random bytes
-func (h *DownloadHandler) generateRandomFile(path string, size int64) error {
-	f, err := os.Create(path)
+// HashMismatchResponse is the error body of a hash mismatch when Debug is on. If the recomputed
+// hash matches the client's, the file was corrupted at rest; otherwise it was the transfer, or the
+// client's hashing.
+type HashMismatchResponse struct {
+	ErrorResponse
+	RecomputedHash string `json:"recomputed_hash"` // SHA-256 of the file as it is on disk now
+}
+
+// writeHashMismatchDebug answers a hash mismatch with a fresh hash of the session's file at path.
+// The rehash is only an extra, so when no hashing slot is free the plain mismatch is reported.
+func (h *DownloadHandler) writeHashMismatchDebug(w http.ResponseWriter, r *http.Request, path string) {
+	release, err := acquireSlot(r.Context(), h.hashSlots, h.cfg.HashWait, errHashBusy)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeHashMismatch, "Hash mismatch")
+		return
+	}
+	_, span := startSpan(r.Context(), "hash")
+	recomputed, err := computeFileHash(path, h.cfg.HashBufferKB*1024)
+	endSpan(span, err)
+	release()
 	if err != nil {
-		return err
+		log.Printf("Error rehashing %s after a mismatch: %v", path, err)
+		writeJSONError(w, http.StatusBadRequest, CodeHashMismatch, "Hash mismatch")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(HashMismatchResponse{
+		ErrorResponse:  ErrorResponse{Error: "Hash mismatch", Code: CodeHashMismatch},
+		RecomputedHash: recomputed,
+	})
+}
+
+// receivedBytesMismatch compares the byte count a client reports against what a complete download of
+// sess delivers: the file size, or for timed sessions what the stream sent. A truncated download can
+// be caught this way without relying on the hash. It returns a description of the mismatch, or ""
+// when the counts agree or none was reported. The caller must hold h.mu.
+func receivedBytesMismatch(sess *Session, received *int64) string {
+	if received == nil {
+		return ""
+	}
+	expected := sess.FileSize
+	if sess.Duration > 0 {
+		expected = sess.BytesTransferred
+	}
+	if *received == expected {
+		return ""
+	}
+	return fmt.Sprintf("received_bytes is %d, expected %d", *received, expected)
+}
+
+// completeVerification records a verified result and then, unless keep is set, deletes the file and
+// the session. Kept sessions can be downloaded and verified again until they expire. The caller
+// must hold h.mu.
+func (h *DownloadHandler) completeVerification(sessionID string, sess *Session, keep bool) error {
+	if !keep {
+		// Attempt to delete the file
+		if err := h.removeSessionFile(sess); err != nil {
+			return err
+		}
+	}
+
+	h.recordResult(sessionID, sess, ResultVerified)
+	if !keep {
+		// Remove session after successful deletion
+		delete(h.sessions, sessionID)
+	}
+	return nil
+}
+
+// setPayloadHeaders marks a test payload so caches and compressing proxies or CDNs pass it through
+// unchanged. A compressed payload would inflate the apparent download speed.
+func setPayloadHeaders(header http.Header) {
+	header.Set("Cache-Control", "no-cache, no-store, must-revalidate, no-transform")
+	header.Set("Content-Encoding", "identity")
+}
+
+// countingWriter counts the body bytes written through it and remembers the status and the last
+// write error, so a transfer cut short by the client can be told apart from a complete one
+type countingWriter struct {
+	http.ResponseWriter
+	status     int // 0 until WriteHeader is called, which means 200 once the body is written
+	written    int64
+	err        error
+	firstWrite time.Time // When the body started; zero until then
+}
+
+// startBody notes when the first write of the body began
+func (cw *countingWriter) startBody() {
+	if cw.firstWrite.IsZero() {
+		cw.firstWrite = time.Now()
+	}
+}
+
+func (cw *countingWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.startBody()
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's sendfile fast path available to ServeContent
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	cw.startBody()
+	n, err := io.Copy(cw.ResponseWriter, src)
+	cw.written += n
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// downloadOutcome classifies a download of r that stopped with err: DownloadCancelled when the client
+// went away, so it isn't counted as a failure of the server or the link, and DownloadIncomplete
+// otherwise, e.g. when a transfer deadline cut it off
+func downloadOutcome(r *http.Request, err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(r.Context().Err(), context.Canceled) {
+		return DownloadCancelled
+	}
+	return DownloadIncomplete
+}
+
+// unreliable reports whether sess's download finished having transferred too little for its speed to
+// be trusted
+func (h *DownloadHandler) unreliable(sess *Session) bool {
+	return sess.DownloadStatus == DownloadComplete && sess.BytesTransferred < int64(h.cfg.MinReliableMB)*1024*1024
+}
+
+// computeSpeedMbps converts a number of bytes transferred over the given duration to Mbps
+func computeSpeedMbps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return (float64(bytes) * 8) / (elapsed.Seconds() * 1024 * 1024)
+}
+
+// generateRandomFile creates a file of the given size filled with random bytes and returns its
+// SHA-256 hash, computed as the bytes are written so the file never has to be read back. Large
+// files are generated in parallel instead, except with direct I/O, whose aligned writes are only
+// done for a single stream. Parallel output depends on the worker count, so seeded files go through
+// generateFile as one stream, the same bytes a dry run hashes. It stops early and returns the
+// context's error if ctx is cancelled.
+func (h *DownloadHandler) generateRandomFile(ctx context.Context, path string, size int64) (string, error) {
+	if workers := generateWorkers(size); workers > 1 && !h.cfg.DirectIO {
+		return h.generateRandomFileParallel(ctx, path, size, workers)
+	}
+
+	f, err := h.createGeneratedFile(path)
+	if err != nil {
+		return "", err
 	}
 	defer f.Close()
 
+	hasher := sha256.New()
+	out := io.MultiWriter(f, hasher)
+	if err := writeRandomData(ctx, out, size, seedOrNow(nil), h.cfg.GenerateBufferKB*1024); err != nil {
+		return "", err
+	}
+	if err := f.finish(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// seedOrNow returns seed, or a time-based seed when none was given
+func seedOrNow(seed *int64) int64 {
+	if seed != nil {
+		return *seed
+	}
+	return time.Now().UnixNano()
+}
+
+// writeRandomData writes size bytes from a PRNG seeded with seed to out, bufSize bytes at a time.
+// The same seed and size always produce the same bytes, whatever the buffer size. It stops early and
+// returns the context's error if ctx is cancelled.
+func writeRandomData(ctx context.Context, out io.Writer, size int64, seed int64, bufSize int) error {
+	rng := rand.New(rand.NewSource(seed))
+
 	// For simplicity, just write random bytes
-	buf := make([]byte, 1024*1024) // 1MB buffer
+	buf := make([]byte, bufSize)
 	totalWritten := int64(0)
 
-	rand.Seed(time.Now().UnixNano())
 	for totalWritten < size {
-		// If we need less than 1MB to finish, adjust
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// If we need less than a full buffer to finish, adjust
 		remain := size - totalWritten
 		toWrite := len(buf)
 		if int64(toWrite) > remain {
 			toWrite = int(remain)
 		}
 
-		_, err := rand.Read(buf[:toWrite])
+		_, err := rng.Read(buf[:toWrite])
 		if err != nil {
 			return err
 		}
 
-		n, err := f.Write(buf[:toWrite])
+		n, err := out.Write(buf[:toWrite])
 		if err != nil {
 			return err
 		}
@@ -320,8 +1268,82 @@ func (h *DownloadHandler) generateRandomFile(path string, size int64) error {
 	return nil
 }
 
-// computeFileHash computes the SHA-256 hash of a file
-func computeFileHash(path string) (string, error) {
+// hashesEqual compares two hex digests on their decoded bytes in constant time, so the comparison
+// leaks nothing about how much of a digest matched. Anything that isn't valid hex never matches.
+func hashesEqual(a, b string) bool {
+	aBytes, errA := hex.DecodeString(a)
+	bBytes, errB := hex.DecodeString(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(aBytes, bBytes) == 1
+}
+
+// validateHashFormat checks that value is a hex digest of the right length for the algorithm
+func validateHashFormat(algorithm, value string) error {
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+
+	size := newHash().Size()
+	if len(value) != hex.EncodedLen(size) {
+		return fmt.Errorf("expected %d hex characters for %s, got %d", hex.EncodedLen(size), algorithm, len(value))
+	}
+	if _, err := hex.DecodeString(value); err != nil {
+		return errors.New("not a valid hex string")
+	}
+	return nil
+}
+
+// dataPath resolves name inside dataDir, one of the configured data directories. name must be a
+// plain file name: absolute paths, separators and "." or ".." are rejected, as is anything else that
+// would resolve outside of dataDir.
+func (h *DownloadHandler) dataPath(dataDir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	dir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Clean(filepath.Join(dir, name))
+	if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q escapes data directory %s", name, dir)
+	}
+	return path, nil
+}
+
+// pickDataDir returns the data directory for the next new file, taking them in turn so files (and
+// the reads serving them) are spread across disks
+func (h *DownloadHandler) pickDataDir() string {
+	return h.dataDirs[(h.nextDataDir.Add(1)-1)%uint64(len(h.dataDirs))]
+}
+
+// removeSessionFile deletes a session's backing file, or releases its reference to a shared one,
+// along with its compressible file if it has one. Timed sessions have none. The caller must hold h.mu.
+func (h *DownloadHandler) removeSessionFile(sess *Session) error {
+	if c := sess.Compressible; c != nil {
+		sess.Compressible = nil
+		if err := os.Remove(c.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing compressible file: %v", err)
+		}
+	}
+	if sess.shared != nil {
+		sf := sess.shared
+		sess.shared = nil
+		return h.releaseSharedFile(sf)
+	}
+	if sess.FilePath == "" {
+		return nil
+	}
+	return os.Remove(sess.FilePath)
+}
+
+// computeFileHash computes the SHA-256 hash of a file by reading it back from disk, bufSize bytes
+// at a time. Generation hashes inline, so this is only needed for files that already exist.
+func computeFileHash(path string, bufSize int) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
@@ -329,12 +1351,18 @@ func computeFileHash(path string) (string, error) {
 	defer f.Close()
 
 	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	if _, err := io.CopyBuffer(h, readerOnly{f}, make([]byte, bufSize)); err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// readerOnly hides everything but Read, so io.CopyBuffer uses the buffer it is given. *os.File
+// implements WriterTo, which would otherwise copy through io.Copy's default 32 KB buffer.
+type readerOnly struct {
+	io.Reader
+}
+
 func (h *DownloadHandler) StartCleanup() {
 	go func() {
 		ticker := time.NewTicker(1 * time.Minute) // Check every minute
@@ -343,20 +1371,17 @@ func (h *DownloadHandler) StartCleanup() {
 		for range ticker.C {
 			h.mu.Lock()
 			now := time.Now()
-			for sessionID, sess := range h.sessions {
-				if now.Sub(sess.CreatedAt) > time.Hour {
-					log.Printf("Cleaning up session: %s", sessionID)
-
-					// Delete file
-					if err := os.Remove(sess.FilePath); err != nil {
-						log.Printf("Failed to delete file %s: %v", sess.FilePath, err)
-					}
-
-					// Remove session
-					delete(h.sessions, sessionID)
-				}
-			}
+			h.expireSessions(now)
+			h.evictIdempotencyKeys(now)
+			h.evictRateLimits(now)
+			h.evictHostnames(now)
+			h.evictResults(now)
+			h.evictSeededHashes(now)
 			h.mu.Unlock()
+
+			h.statsClock.Store(now.Unix())
+			h.evictBytesSentByIP(now)
+			h.sweepOrphanedFiles(false)
 		}
 	}()
 }
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHandler returns a handler with the default config, keeping its files in a temporary
+// directory
+func newTestHandler(t testing.TB) *DownloadHandler {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	return NewDownloadHandler(cfg)
+}
+
+// initTestSession creates a session of sizeMB through InitDownload
+func initTestSession(t testing.TB, h *DownloadHandler, sizeMB int) DownloadInitResponse {
+	t.Helper()
+	body := strings.NewReader(`{"size_mb":` + strconv.Itoa(sizeMB) + `}`)
+	req := httptest.NewRequest(http.MethodPost, "/download/init", body)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.InitDownload(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("init: status %d: %s", rec.Code, rec.Body)
+	}
+	var resp DownloadInitResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	return resp
+}
+
+func TestDownloadPayloadIsIncompressible(t *testing.T) {
+	h := newTestHandler(t)
+	sess := initTestSession(t, h, 5)
+
+	req := httptest.NewRequest(http.MethodGet, "/download/data?session_id="+sess.SessionID, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.DownloadData(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("download: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if got := rec.Header().Get("Content-Encoding"); got != "identity" {
+		t.Errorf("Content-Encoding = %q, want identity", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); !headerHasToken(rec.Header(), "Cache-Control", "no-transform") {
+		t.Errorf("Cache-Control = %q, want no-transform", got)
+	}
+	if int64(rec.Body.Len()) != sess.Size {
+		t.Fatalf("body is %d bytes, want %d", rec.Body.Len(), sess.Size)
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(rec.Body.Bytes())
+	zw.Close()
+	if compressed.Len() < rec.Body.Len() {
+		t.Errorf("gzip shrank the payload from %d to %d bytes", rec.Body.Len(), compressed.Len())
+	}
+}
+
+func TestDataPathStaysInDataDir(t *testing.T) {
+	h := newTestHandler(t)
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"session.bin", false},
+		{"shared-5242880-abc.bin", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"../x", true},
+		{"../../etc/passwd", true},
+		{"a/../../b", true},
+		{"a/../b", true},
+		{"pool/x.bin", true},
+		{`..\x`, true},
+		{`a\b`, true},
+		{"/etc/passwd", true},
+		{dir + "/x.bin", true},
+	}
+	for _, tt := range tests {
+		path, err := h.dataPath(dir, tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("dataPath(%q) error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && filepath.Dir(path) != dir {
+			t.Errorf("dataPath(%q) = %q, outside %s", tt.name, path, dir)
+		}
+	}
+}
+
+// BenchmarkGenerateRandomFile compares hashing while generating with writing the file and then
+// reading it back to hash it, on a single-stream 64 MB file
+func BenchmarkGenerateRandomFile(b *testing.B) {
+	const size = 64 * 1024 * 1024
+	h := newTestHandler(b)
+	bufSize := h.cfg.GenerateBufferKB * 1024
+
+	b.Run("inline", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			path := filepath.Join(h.dataDirs[0], "bench.bin")
+			if _, err := h.generateRandomFile(context.Background(), path, size); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("write-then-hash", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			path := filepath.Join(h.dataDirs[0], "bench.bin")
+			f, err := os.Create(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = writeRandomData(context.Background(), f, size, int64(i), bufSize)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := computeFileHash(path, h.cfg.HashBufferKB*1024); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkWriteRandomData measures generating 64 MB of random data at each allowed buffer size
+func BenchmarkWriteRandomData(b *testing.B) {
+	const size = 64 * 1024 * 1024
+	for kb := MinGenerateBufferKB; kb <= MaxGenerateBufferKB; kb *= 4 {
+		b.Run(strconv.Itoa(kb)+"KB", func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if err := writeRandomData(context.Background(), io.Discard, size, int64(i), kb*1024); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkComputeFileHash measures hashing a 1000 MB file at buffer sizes across the allowed range.
+// After the first pass the file is in page cache, so this shows SHA-256's cost rather than the disk's.
+func BenchmarkComputeFileHash(b *testing.B) {
+	const size = 1000 * 1024 * 1024
+	path := filepath.Join(b.TempDir(), "hash.bin")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = writeRandomData(context.Background(), f, size, 1, MaxGenerateBufferKB*1024)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, kb := range []int{MinHashBufferKB, 64, 256, 1024, 4096, MaxHashBufferKB} {
+		b.Run(strconv.Itoa(kb)+"KB", func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := computeFileHash(path, kb*1024); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// blockingWriter holds up every write of a response until release is closed
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	<-bw.release
+	return bw.ResponseRecorder.Write(p)
+}
+
+// TestCompressibleDownloadRacesVerify verifies the session, which clears its compressible payload,
+// while that payload is being downloaded; run with -race
+func TestCompressibleDownloadRacesVerify(t *testing.T) {
+	h := newTestHandler(t)
+	req := httptest.NewRequest(http.MethodPost, "/download/init", strings.NewReader(`{"size_mb":5,"compressible":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.InitDownload(rec, req)
+	var sess DownloadInitResponse
+	if err := json.NewDecoder(rec.Body).Decode(&sess); err != nil || sess.SessionID == "" {
+		t.Fatalf("init: status %d: %v", rec.Code, err)
+	}
+
+	bw := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/download/data?payload=compressible&session_id="+sess.SessionID, nil)
+		h.DownloadData(bw, req)
+	}()
+	// Wait for the download to start, through h.mu only: anything else would order its read of the
+	// payload before the verification and hide the race
+	for {
+		h.mu.Lock()
+		active := h.sessions[sess.SessionID].activeDownloads
+		h.mu.Unlock()
+		if active > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	body := `{"session_id":"` + sess.SessionID + `","computed_hash":"` + sess.ExpectedHash + `"}`
+	req = httptest.NewRequest(http.MethodPost, "/download/verify", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	h.VerifyDownload(httptest.NewRecorder(), req)
+	close(bw.release)
+	<-done
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// dryRunSeed seeds the generator for dry runs without a seed, so the expected hash for a size never
+// changes
+const dryRunSeed = 0
+
+// dryRunInit answers an init request with the hash the requested size would have when generated
+// from the request's seed, or dryRunSeed, without writing a file or creating a session. Monitors
+// can use it to check the server end to end without consuming storage.
+func (h *DownloadHandler) dryRunInit(w http.ResponseWriter, r *http.Request, req DownloadInitRequest) {
+	if !h.checkLoad(w) {
+		return
+	}
+	if !h.checkRateLimit(w, r, initCostMB(req)) {
+		return
+	}
+	if req.DurationSec != 0 {
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "dry_run is not supported for timed downloads")
+		return
+	}
+	if req.Compressible {
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "dry_run is not supported with compressible")
+		return
+	}
+	if err := validateGeneration(req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+	size, ok := h.requestedSize(req)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidSize, invalidSizeMessage())
+		return
+	}
+
+	seed := int64(dryRunSeed)
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+
+	key := newSeededKey(req.Generation, size, seed)
+	expectedHash, ok := h.cachedSeededHash(key)
+	if !ok && req.Generation == GenerationZero {
+		expectedHash, ok = zeroHashes[size]
+	}
+	if !ok {
+		hasher := sha256.New()
+		if err := writeGeneratedData(r.Context(), hasher, req.Generation, size, seed, h.cfg.GenerateBufferKB*1024); err != nil {
+			log.Printf("Error computing dry-run hash: %v", err)
+			w.WriteHeader(StatusClientClosedRequest)
+			return
+		}
+		expectedHash = hex.EncodeToString(hasher.Sum(nil))
+		h.cacheSeededHash(key, expectedHash)
+	}
+
+	resp := DownloadInitResponse{
+		Size:          size,
+		HashAlgorithm: "sha256",
+		ExpectedHash:  expectedHash,
+		DryRun:        true,
+
+		RecommendedConnections: h.recommendedConnections(size, false),
+	}
+	if !isRandomGeneration(req.Generation) {
+		resp.Generation = req.Generation
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
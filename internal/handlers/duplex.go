@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// duplexJoinTimeout is how long the first direction of a duplex test waits for the second to arrive
+const duplexJoinTimeout = 10 * time.Second
+
+// Directions of a duplex test
+const (
+	duplexDownload = "download"
+	duplexUpload   = "upload"
+)
+
+// duplexTest coordinates a download and an upload on one session that run at the same time. Both
+// wait for each other before starting, and the speeds are measured over the window in which both
+// were running: from the common start until the first direction finishes.
+type duplexTest struct {
+	ready  chan struct{} // Closed once both directions have joined
+	start  time.Time     // Set before ready is closed
+	joined map[string]bool
+
+	down atomic.Int64 // Bytes sent so far
+	up   atomic.Int64 // Bytes received so far
+
+	// Guarded by h.mu
+	finished     int
+	failed       bool
+	windowEnd    time.Time
+	downInWindow int64
+	upInWindow   int64
+}
+
+// DuplexResult is the outcome of the last duplex test on a session
+type DuplexResult struct {
+	Status    string // DownloadComplete, or DownloadIncomplete if either direction failed
+	DownMbps  float64
+	UpMbps    float64
+	Window    time.Duration
+	DownBytes int64
+	UpBytes   int64
+}
+
+type DuplexResponse struct {
+	SessionID string  `json:"session_id"`
+	Status    string  `json:"status"` // pending until both directions have finished
+	DownMbps  float64 `json:"down_mbps"`
+	UpMbps    float64 `json:"up_mbps"`
+	TotalMbps float64 `json:"total_mbps"`
+	WindowMs  float64 `json:"window_ms"` // How long both directions ran at once
+	DownBytes int64   `json:"down_bytes"`
+	UpBytes   int64   `json:"up_bytes"` // Bytes transferred within the window
+}
+
+// wantsDuplex reports whether a transfer asked to be part of a duplex test
+func wantsDuplex(r *http.Request) bool {
+	return r.URL.Query().Get("duplex") == "true"
+}
+
+// joinDuplex registers one direction of a duplex test on sess and waits for the other direction,
+// so both start together. On failure, including when the other direction doesn't arrive within
+// duplexJoinTimeout, it writes the error response itself and returns false.
+func (h *DownloadHandler) joinDuplex(w http.ResponseWriter, r *http.Request, sess *Session, direction string) (*duplexTest, bool) {
+	if sess.Duration > 0 {
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "duplex is not supported for timed sessions")
+		return nil, false
+	}
+
+	h.mu.Lock()
+	dt := sess.duplex
+	if dt == nil {
+		dt = &duplexTest{ready: make(chan struct{}), joined: make(map[string]bool, 2)}
+		sess.duplex = dt
+	}
+	if dt.joined[direction] {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, CodeDuplexInProgress, "A duplex "+direction+" is already running on this session")
+		return nil, false
+	}
+	dt.joined[direction] = true
+	if len(dt.joined) == 2 {
+		dt.start = time.Now()
+		close(dt.ready)
+	}
+	h.mu.Unlock()
+
+	timer := time.NewTimer(duplexJoinTimeout)
+	defer timer.Stop()
+	select {
+	case <-dt.ready:
+		return dt, true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(dt.joined) == 2 {
+		// The other direction arrived just as this one gave up
+		return dt, true
+	}
+	sess.duplex = nil
+	writeJSONError(w, http.StatusRequestTimeout, CodeDuplexTimeout, "The other direction of the duplex test did not start within "+duplexJoinTimeout.String())
+	return nil, false
+}
+
+// finishDuplex records the end of one direction. The first to finish closes the measurement window;
+// the second stores the result on sess.
+func (h *DownloadHandler) finishDuplex(sess *Session, dt *duplexTest, ok bool) {
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	dt.failed = dt.failed || !ok
+	dt.finished++
+	if dt.finished == 1 {
+		dt.windowEnd = now
+		dt.downInWindow = dt.down.Load()
+		dt.upInWindow = dt.up.Load()
+		return
+	}
+
+	window := dt.windowEnd.Sub(dt.start)
+	result := &DuplexResult{
+		Status:    DownloadComplete,
+		DownMbps:  computeSpeedMbps(dt.downInWindow, window),
+		UpMbps:    computeSpeedMbps(dt.upInWindow, window),
+		Window:    window,
+		DownBytes: dt.downInWindow,
+		UpBytes:   dt.upInWindow,
+	}
+	if dt.failed {
+		result = &DuplexResult{Status: DownloadIncomplete}
+	}
+	sess.Duplex = result
+	sess.duplex = nil
+}
+
+// progressWriter adds the bytes written through it to n as they go, so another goroutine can read
+// how far the response is. It leaves out ReadFrom, so sendfile can't bypass it.
+type progressWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.ResponseWriter.Write(p)
+	pw.n.Add(int64(n))
+	return n, err
+}
+
+func (pw *progressWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// progressReader adds the bytes read through it to n as they go
+type progressReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.Reader.Read(p)
+	pr.n.Add(int64(n))
+	return n, err
+}
+
+// GetDuplexResult reports the speeds of the last duplex test on a session
+func (h *DownloadHandler) GetDuplexResult(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		writeJSONError(w, http.StatusBadRequest, CodeSessionIDRequired, "session_id is required")
+		return
+	}
+
+	h.mu.Lock()
+	sess, status := h.findSession(sessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
+		return
+	}
+	resp := DuplexResponse{SessionID: sessionID, Status: DownloadPending}
+	if res := sess.Duplex; res != nil {
+		resp.Status = res.Status
+		resp.DownMbps = res.DownMbps
+		resp.UpMbps = res.UpMbps
+		resp.TotalMbps = res.DownMbps + res.UpMbps
+		resp.WindowMs = float64(res.Window) / float64(time.Millisecond)
+		resp.DownBytes = res.DownBytes
+		resp.UpBytes = res.UpBytes
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
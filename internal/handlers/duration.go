@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxDurationSec bounds how long a timed download may stream
+	maxDurationSec = 60
+	// streamChunkSize is kept small so a timed stream stops close to its deadline
+	streamChunkSize = 64 * 1024
+)
+
+// initTimedSession registers a session that streams for a fixed time instead of serving a file of a
+// fixed size, so the test length adapts to the link speed. On failure it writes the error response
+// itself and returns false.
+func (h *DownloadHandler) initTimedSession(w http.ResponseWriter, req DownloadInitRequest, sess *Session) (string, *Session, bool) {
+	if req.SizeMB != 0 {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidDuration, "size_mb and duration_sec are mutually exclusive")
+		return "", nil, false
+	}
+	if req.Compressible {
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "compressible is not supported for timed downloads")
+		return "", nil, false
+	}
+	if !isRandomGeneration(req.Generation) {
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "generation "+req.Generation+" is not supported for timed downloads")
+		return "", nil, false
+	}
+	if req.DurationSec < 1 || req.DurationSec > maxDurationSec {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidDuration, fmt.Sprintf("duration_sec must be between 1 and %d", maxDurationSec))
+		return "", nil, false
+	}
+
+	sessionID := uuid.New().String()
+	sess.Duration = time.Duration(req.DurationSec) * time.Second
+	h.registerSession(sessionID, sess)
+
+	return sessionID, sess, true
+}
+
+// streamForDuration serves freshly generated random data until the session's duration has elapsed.
+// The data is hashed on the way out and stored as the session's expected hash, so the client can
+// still verify what it received. accepted is when DownloadData took the request, for the session's
+// time to first byte.
+func (h *DownloadHandler) streamForDuration(w http.ResponseWriter, r *http.Request, sessionID string, sess *Session, accepted time.Time) {
+	setPayloadHeaders(w.Header())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	h.setResponseHeaders(w.Header())
+	hashTrailer := wantsHashTrailer(r)
+	trailers := wantsTrailers(r) || hashTrailer
+	if trailers {
+		declareResultTrailers(w.Header())
+	}
+	if hashTrailer {
+		declareHashTrailer(w.Header())
+	}
+	if h.cfg.MinBandwidthMbps > 0 {
+		setTransferDeadline(w, sess.Duration+transferDeadlineGrace)
+	}
+
+	out := h.throttle(w, r)
+	rng := rand.New(rand.NewSource(seedOrNow(sess.Seed)))
+	hasher := sha256.New()
+	buf := make([]byte, streamChunkSize)
+	var sent int64
+	var writeErr error
+
+	// Start tracking time
+	startTime := time.Now()
+	deadline := startTime.Add(sess.Duration)
+
+	for time.Now().Before(deadline) {
+		rng.Read(buf)
+		n, err := out.Write(buf)
+		hasher.Write(buf[:n])
+		sent += int64(n)
+		if err != nil {
+			writeErr = err
+			break
+		}
+	}
+
+	// End tracking time
+	elapsed := time.Since(startTime)
+
+	h.recordBytesSent(getClientIP(r), sent)
+
+	if writeErr != nil {
+		outcome := downloadOutcome(r, writeErr)
+		h.mu.Lock()
+		sess.BytesTransferred = sent
+		sess.DownloadSpeedMbps = 0
+		sess.DownloadStatus = outcome
+		h.mu.Unlock()
+		h.recordDownloadOutcome(outcome)
+
+		log.Printf("Timed download for session %s %s after %d bytes: %v", sessionID, outcome, sent, writeErr)
+		return
+	}
+
+	speedMbps := computeSpeedMbps(sent, elapsed)
+	traceTransfer(r.Context(), sent, speedMbps)
+
+	expectedHash := hex.EncodeToString(hasher.Sum(nil))
+	tcpInfo := requestTCPInfo(r)
+
+	h.mu.Lock()
+	sess.ExpectedHash = expectedHash
+	sess.BytesTransferred = sent
+	sess.DownloadSpeedMbps = speedMbps
+	sess.DownloadProto = r.Proto
+	sess.DownloadStatus = DownloadComplete
+	sess.TCPInfo = tcpInfo
+	sess.TTFB = startTime.Sub(accepted)
+	recordStream(sess, sent, speedMbps)
+	h.mu.Unlock()
+	h.recordDownloadOutcome(DownloadComplete)
+
+	if trailers {
+		setResultTrailers(w.Header(), speedMbps, sent)
+	}
+	if hashTrailer {
+		w.Header().Set(TrailerSHA256, expectedHash)
+	}
+
+	log.Printf("Timed download for session %s: %d bytes in %s, %.2f Mbps over %s", sessionID, sent, elapsed, speedMbps, r.Proto)
+}
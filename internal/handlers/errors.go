@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorCode is a stable, machine-readable identifier for an error. Clients should branch on it
+// rather than on the human-readable message, which may change.
+type ErrorCode string
+
+const (
+	CodeBadRequest         ErrorCode = "BAD_REQUEST"          // Body could not be decoded
+	CodeBodyTooLarge       ErrorCode = "BODY_TOO_LARGE"       // The request body exceeds the endpoint's limit
+	CodeBadMediaType       ErrorCode = "BAD_MEDIA_TYPE"       // The body is not application/json
+	CodeInvalidParameter   ErrorCode = "INVALID_PARAMETER"    // A query or body field has a bad value
+	CodeInvalidSize        ErrorCode = "INVALID_SIZE"         // size_mb is not one of the allowed sizes
+	CodeInvalidDuration    ErrorCode = "INVALID_DURATION"     // duration_sec is out of range or combined with size_mb
+	CodeInvalidTags        ErrorCode = "INVALID_TAGS"         // tags break the count or length limits
+	CodeUnsupported        ErrorCode = "UNSUPPORTED"          // The option can't be used with this kind of session
+	CodeRateLimited        ErrorCode = "RATE_LIMITED"         // Too many inits from this client
+	CodeSessionIDRequired  ErrorCode = "SESSION_ID_REQUIRED"  // session_id was not given
+	CodeSessionNotFound    ErrorCode = "SESSION_NOT_FOUND"    // No such session ever existed (or it was verified)
+	CodeSessionExpired     ErrorCode = "SESSION_EXPIRED"      // The session existed but has expired
+	CodeTooManyConnections ErrorCode = "TOO_MANY_CONNECTIONS" // The session already has the maximum parallel downloads
+	CodeSessionConsumed    ErrorCode = "SESSION_CONSUMED"     // The session has been downloaded the maximum number of times
+	CodeKeepaliveLimit     ErrorCode = "KEEPALIVE_LIMIT"      // The session can't be extended any further
+	CodeDownloadPending    ErrorCode = "DOWNLOAD_PENDING"     // The session has no finished download yet
+	CodeMalformedHash      ErrorCode = "MALFORMED_HASH"       // A computed hash isn't a valid digest for its algorithm
+	CodeHashMismatch       ErrorCode = "HASH_MISMATCH"        // The computed hash doesn't match the file
+	CodeSizeMismatch       ErrorCode = "SIZE_MISMATCH"        // The reported received_bytes doesn't match the file
+	CodeUploadTooLarge     ErrorCode = "UPLOAD_TOO_LARGE"     // The upload body exceeds the configured limit
+	CodeUploadFailed       ErrorCode = "UPLOAD_FAILED"        // The upload body could not be read
+	CodeNotFound           ErrorCode = "NOT_FOUND"            // No route for the path
+	CodeFixtureNotFound    ErrorCode = "FIXTURE_NOT_FOUND"    // No fixture has the requested name
+	CodeMethodNotAllowed   ErrorCode = "METHOD_NOT_ALLOWED"   // The path exists but not for this method
+	CodeUnauthorized       ErrorCode = "UNAUTHORIZED"         // The admin token is missing or wrong
+	CodeForbidden          ErrorCode = "FORBIDDEN"            // The client IP is refused by the allow/deny lists
+	CodeServerBusy         ErrorCode = "SERVER_BUSY"          // No generation slot freed up in time
+	CodeDuplexTimeout      ErrorCode = "DUPLEX_TIMEOUT"       // The other direction of a duplex test never started
+	CodeDuplexInProgress   ErrorCode = "DUPLEX_IN_PROGRESS"   // The session already runs this direction of a duplex test
+	CodePhaseOutOfOrder    ErrorCode = "PHASE_OUT_OF_ORDER"   // A full test phase was requested before its turn or after it ended
+	CodeInternal           ErrorCode = "INTERNAL"             // Something went wrong on the server
+)
+
+type ErrorResponse struct {
+	Error string    `json:"error"`
+	Code  ErrorCode `json:"code"`
+}
+
+// writeJSONError writes a JSON error body with the given status code
+func writeJSONError(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: message, Code: code})
+}
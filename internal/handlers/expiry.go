@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// sessionExpiry is when sess stops being served and becomes eligible for cleanup
+func (h *DownloadHandler) sessionExpiry(sess *Session) time.Time {
+	return sess.LastSeen.Add(h.cfg.SessionTTL)
+}
+
+// findSession looks up a live session. When there is none it returns the status to answer with:
+// 410 Gone if the session existed but has expired, 404 Not Found otherwise. The caller must hold h.mu.
+func (h *DownloadHandler) findSession(sessionID string) (*Session, int) {
+	sess, exists := h.sessions[sessionID]
+	if exists && time.Now().Before(h.sessionExpiry(sess)) {
+		return sess, http.StatusOK
+	}
+	if _, expired := h.expiredSessions[sessionID]; exists || expired {
+		return nil, http.StatusGone
+	}
+	return nil, http.StatusNotFound
+}
+
+// writeSessionError writes the response for a failed findSession
+func writeSessionError(w http.ResponseWriter, status int) {
+	if status == http.StatusGone {
+		writeJSONError(w, http.StatusGone, CodeSessionExpired, "Session expired")
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, CodeSessionNotFound, "Invalid session_id")
+}
+
+// expireSessions removes sessions past their expiry, leaving a tombstone for each so later requests
+// get 410 rather than 404. Tombstones are kept for another SessionTTL. The caller must hold h.mu.
+func (h *DownloadHandler) expireSessions(now time.Time) {
+	for sessionID, sess := range h.sessions {
+		if now.Before(h.sessionExpiry(sess)) {
+			continue
+		}
+		log.Printf("Cleaning up session: %s", sessionID)
+
+		// Delete file
+		if err := h.removeSessionFile(sess); err != nil {
+			log.Printf("Failed to delete file %s: %v", sess.FilePath, err)
+		}
+
+		// Remove session
+		delete(h.sessions, sessionID)
+		h.expiredSessions[sessionID] = now
+	}
+
+	for sessionID, expiredAt := range h.expiredSessions {
+		if now.Sub(expiredAt) > h.cfg.SessionTTL {
+			delete(h.expiredSessions, sessionID)
+		}
+	}
+}
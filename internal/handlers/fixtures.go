@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// fixtureNamePattern is what a fixture file must be named like to be served. Anything else in the
+// fixture directory, including subdirectories and dotfiles, is ignored.
+var fixtureNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// fixture is an operator-provided file with known content, hashed once at startup
+type fixture struct {
+	path    string
+	size    int64
+	modTime time.Time
+	hash    string // SHA-256
+}
+
+// loadFixtures hashes every suitably named regular file directly inside dir. The result is the
+// allowlist /download/fixture serves from; names are only ever looked up in it, never joined onto
+// a path. Fixtures are optional, so an unreadable directory or file is logged and skipped.
+func loadFixtures(dir string, bufSize int) map[string]fixture {
+	fixtures := make(map[string]fixture)
+	if dir == "" {
+		return fixtures
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Fixture directory %s unavailable, no fixtures will be served: %v", dir, err)
+		return fixtures
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !fixtureNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			log.Printf("Error reading fixture %s: %v", path, err)
+			continue
+		}
+		hash, err := computeFileHash(path, bufSize)
+		if err != nil {
+			log.Printf("Error hashing fixture %s: %v", path, err)
+			continue
+		}
+		fixtures[entry.Name()] = fixture{path: path, size: info.Size(), modTime: info.ModTime(), hash: hash}
+	}
+	log.Printf("Loaded %d fixtures from %s", len(fixtures), dir)
+	return fixtures
+}
+
+// DownloadFixture serves a named fixture as is, with its SHA-256 in X-Content-Sha256 and as the
+// ETag. Unlike /download/data nothing is generated, measured or recorded, so clients get the same
+// bytes every time. Ranges and HEAD work as for any static file.
+func (h *DownloadHandler) DownloadFixture(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !fixtureNamePattern.MatchString(name) {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "name must be 1-128 letters, digits, '.', '_' or '-', not starting with a punctuation character")
+		return
+	}
+	fx, ok := h.fixtures[name]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, CodeFixtureNotFound, "No such fixture: "+name)
+		return
+	}
+
+	f, err := os.Open(fx.path)
+	if err != nil {
+		log.Printf("Error opening fixture %s: %v", fx.path, err)
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+	defer f.Close()
+
+	// The hash is only good for the file as it was at startup
+	info, err := f.Stat()
+	if err != nil || info.Size() != fx.size || !info.ModTime().Equal(fx.modTime) {
+		log.Printf("Fixture %s changed since startup; restart the server to rehash it", fx.path)
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Fixture changed on disk")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-transform")
+	w.Header().Set("ETag", payloadETag(fx.hash))
+	w.Header().Set(TrailerSHA256, fx.hash)
+	h.setResponseHeaders(w.Header())
+	http.ServeContent(h.throttle(w, r), r, name, fx.modTime, f)
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Phases of a full test, in the order the server lets them run
+const (
+	PhasePending  = "pending"  // Created; nothing has run yet
+	PhasePing     = "ping"     // Idle round trips are being measured
+	PhaseDownload = "download" // Downloads have started; pings now count as loaded
+	PhaseUpload   = "upload"   // The upload has started
+	PhaseDone     = "done"     // An upload completed; no further phase runs
+)
+
+// FullTestInitResponse describes a combined session and the order in which its phases should be run
+type FullTestInitResponse struct {
+	DownloadInitResponse
+	PingURL     string `json:"ping_url"`
+	DownloadURL string `json:"download_url"`
+	UploadURL   string `json:"upload_url"`
+	ResultURL   string `json:"result_url"`
+}
+
+type FullTestResponse struct {
+	SessionID    string  `json:"session_id"`
+	DownloadMbps float64 `json:"download_mbps"`
+	UploadMbps   float64 `json:"upload_mbps"`
+	PingMs       float64 `json:"ping_ms"`        // Idle latency: the lowest RTT measured with no download running
+	LoadedPingMs float64 `json:"loaded_ping_ms"` // Median RTT measured during downloads; 0 if none was taken
+	Phase        string  `json:"phase"`          // The phase the test has reached
+	Complete     bool    `json:"complete"`       // Whether every phase has run
+}
+
+// InitFullTest creates a single session that is used for the ping, download and upload phases.
+// The server walks the session through them in order: requests for a phase that has ended, or
+// whose turn hasn't come, get 409.
+func (h *DownloadHandler) InitFullTest(w http.ResponseWriter, r *http.Request) {
+	var req DownloadInitRequest
+	if !decodeJSONBody(w, r, &req, maxInitBodyBytes) {
+		return
+	}
+
+	req.fullTest = true
+	sessionID, sess, ok := h.initSession(w, r, req)
+	if !ok {
+		return
+	}
+
+	resp := FullTestInitResponse{
+		DownloadInitResponse: h.newInitResponse(sessionID, sess),
+		PingURL:              "/ping?session_id=" + sessionID,
+		DownloadURL:          "/download/data?session_id=" + sessionID,
+		UploadURL:            "/upload/data?session_id=" + sessionID,
+		ResultURL:            "/test/full?session_id=" + sessionID,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding full test response: %v", err)
+	}
+}
+
+// GetFullTestResult combines the ping, download and upload measurements recorded on a session
+func (h *DownloadHandler) GetFullTestResult(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		writeJSONError(w, http.StatusBadRequest, CodeSessionIDRequired, "session_id is required")
+		return
+	}
+
+	h.mu.Lock()
+	sess, status := h.findSession(sessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
+		return
+	}
+	resp := FullTestResponse{
+		SessionID:    sessionID,
+		DownloadMbps: sess.DownloadSpeedMbps,
+		UploadMbps:   sess.UploadSpeedMbps,
+		PingMs:       minPingMs(sess.PingSamples),
+		// The median rather than the minimum, since queuing delay is what is being measured
+		LoadedPingMs: median(append([]float64(nil), sess.LoadedPingSamples...)),
+		Phase:        sess.FullTestPhase,
+		Complete:     sess.FullTestPhase == PhaseDone,
+	}
+	h.mu.Unlock()
+
+	if resp.Phase == "" {
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "Not a full test session; create one with POST /test/full")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// enterPhase lets a request for phase run on sess if that phase is the current one, or the next one
+// and the current phase has produced what it needs, moving the test along. It returns why the
+// request is out of order, or "" when it may run. Sessions that aren't full tests run anything.
+// The caller must hold h.mu.
+func enterPhase(sess *Session, phase string) string {
+	current := sess.FullTestPhase
+	if current == "" || current == phase {
+		return ""
+	}
+
+	switch phase {
+	case PhasePing:
+		switch current {
+		case PhasePending:
+			sess.FullTestPhase = PhasePing
+			return ""
+		case PhaseDownload:
+			return "" // Latency under load
+		}
+	case PhaseDownload:
+		switch current {
+		case PhasePending:
+			return "Run the ping phase first"
+		case PhasePing:
+			if len(sess.PingSamples) == 0 {
+				return "The ping phase has no round trip yet; ping at least twice"
+			}
+			sess.FullTestPhase = PhaseDownload
+			return ""
+		}
+	case PhaseUpload:
+		switch current {
+		case PhasePending, PhasePing:
+			return "Run the download phase first"
+		case PhaseDownload:
+			if sess.DownloadStatus != DownloadComplete || sess.activeDownloads > 0 {
+				return "The download phase hasn't finished"
+			}
+			sess.FullTestPhase = PhaseUpload
+			return ""
+		}
+	}
+	return "The " + phase + " phase is over; the test is in the " + current + " phase"
+}
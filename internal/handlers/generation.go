@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errGenerationBusy is returned when no generation slot freed up within GenerationWait
+var errGenerationBusy = errors.New("timed out waiting for a generation slot")
+
+// acquireGenerationSlot waits until fewer than MaxGenerations files are being generated and takes a
+// slot, so bursts of large inits queue instead of thrashing the disk. It gives up with
+// errGenerationBusy after GenerationWait, or with the context's error if ctx is cancelled first.
+// The returned function gives the slot back.
+func (h *DownloadHandler) acquireGenerationSlot(ctx context.Context) (func(), error) {
+	return acquireSlot(ctx, h.generationSlots, h.cfg.GenerationWait, errGenerationBusy)
+}
+
+// acquireSlot takes a slot of the semaphore slots, waiting at most wait before giving up with busy,
+// or with the context's error if ctx is cancelled first. A nil semaphore is unlimited. The returned
+// function gives the slot back.
+func acquireSlot(ctx context.Context, slots chan struct{}, wait time.Duration, busy error) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-timer.C:
+		return nil, busy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
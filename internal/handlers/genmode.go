@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+// Generation modes for a session's file, chosen with the init request's generation field. Whatever
+// the content, payloads are served with Content-Encoding: identity and Cache-Control: no-transform
+// (see setPayloadHeaders), which is what keeps zero and compressible files honest: without them a
+// compressing proxy would shrink the transfer and inflate the measured speed.
+const (
+	GenerationRandom       = "random"       // Incompressible PRNG data, the default
+	GenerationZero         = "zero"         // All zero bytes; by far the fastest to generate
+	GenerationCompressible = "compressible" // Hex text of PRNG data, compressing about 2:1
+)
+
+// sparseSizes are sizes too large to generate, offered only with generation zero and only when zero
+// files can be sparse (see sparseZeroFiles), so they take no disk space and their hashes are known
+var sparseSizes = map[int]int64{
+	2000:  2000 * 1024 * 1024,
+	5000:  5000 * 1024 * 1024,
+	10000: 10000 * 1024 * 1024,
+}
+
+// isSparseSize reports whether size, in bytes, is one of sparseSizes
+func isSparseSize(size int64) bool {
+	for _, sparse := range sparseSizes {
+		if size == sparse {
+			return true
+		}
+	}
+	return false
+}
+
+// zeroHashes holds the SHA-256 of all-zero content for every allowed and sparse size, so zero files
+// of these sizes are never hashed. Sizes padded by size jitter aren't listed; zeroHash hashes those.
+var zeroHashes = map[int64]string{
+	5 * 1024 * 1024:     "c036cbb7553a909f8b8877d4461924307f27ecb66cff928eeeafd569c3887e29",
+	10 * 1024 * 1024:    "e5b844cc57f57094ea4585e235f36c78c1cd222262bb89d53c94dcb4d6b3e55d",
+	20 * 1024 * 1024:    "cd52d81e25f372e6fa4db2c0dfceb59862c1969cab17096da352b34950c973cc",
+	50 * 1024 * 1024:    "8565a714dca840f8652c5bae9249ab05f5fb5a4f9f13fbe23304b10f68252da2",
+	100 * 1024 * 1024:   "20492a4d0d84f8beb1767f6616229f85d44c2827b64bdbfb260ee12fa1109e0e",
+	200 * 1024 * 1024:   "72abf2ca8f36943ebe2e49ca3a51d409ca5f0bfcffab6c9d25643c17c32889da",
+	500 * 1024 * 1024:   "a08a92258f621b55d08ad1e84c90c2ea6286fc6b6c9a4dfa7156afb16c190170",
+	1000 * 1024 * 1024:  "da87281c9f9ab6cef8f9362935f4fc864db94606d52212614894f1253461a762",
+	2000 * 1024 * 1024:  "274fbb979251bcaceab594dd89d5adfec310e8851e320b5b5f90fd5f18d76149",
+	5000 * 1024 * 1024:  "a33351fafd00e4c4bcdee2a1c5d019026500f8cdfeaf91a9b8dbbb2619429659",
+	10000 * 1024 * 1024: "04700bc2572f2432753a5906b5971639312342444d45db650eabd85d7e2a1454",
+}
+
+// sparseZeroFiles reports whether zero files are created sparse. Operators who asked for fsync or
+// direct I/O want the disk exercised, so generateFile writes real zeros for them instead, and
+// diskless servers create no files at all.
+func (h *DownloadHandler) sparseZeroFiles() bool {
+	return !h.cfg.DirectIO && !h.cfg.FsyncFiles && !h.cfg.Diskless
+}
+
+// requestedSize looks up an init request's size_mb: one of allowedSizes or, for zero content without
+// a compressible payload when files can be sparse, one of sparseSizes
+func (h *DownloadHandler) requestedSize(req DownloadInitRequest) (int64, bool) {
+	if size, ok := allowedSizes[req.SizeMB]; ok {
+		return size, true
+	}
+	if req.Generation != GenerationZero || req.Compressible || !h.sparseZeroFiles() {
+		return 0, false
+	}
+	size, ok := sparseSizes[req.SizeMB]
+	return size, ok
+}
+
+// validateGeneration checks an init request's generation mode. Only random data depends on a seed in
+// a way worth asking for, and zero data doesn't depend on one at all.
+func validateGeneration(req DownloadInitRequest) error {
+	switch req.Generation {
+	case "", GenerationRandom, GenerationCompressible:
+		return nil
+	case GenerationZero:
+		if req.Seed != nil {
+			return errors.New("seed has no effect with generation zero")
+		}
+		return nil
+	default:
+		return errors.New("generation must be one of random, zero, compressible")
+	}
+}
+
+// isRandomGeneration reports whether generation, as stored on a session, is the default random mode
+func isRandomGeneration(generation string) bool {
+	return generation == "" || generation == GenerationRandom
+}
+
+// writeGeneratedData writes size bytes of the given generation mode to out, taking random bytes
+// from a PRNG seeded with seed, bufSize bytes at a time. It stops early and returns the context's
+// error if ctx is cancelled.
+func writeGeneratedData(ctx context.Context, out io.Writer, generation string, size, seed int64, bufSize int) error {
+	switch generation {
+	case GenerationZero:
+		return writeZeroData(ctx, out, size, bufSize)
+	case GenerationCompressible:
+		// Hex encoding doubles the length, so half as many random bytes are needed
+		return writeRandomData(ctx, hex.NewEncoder(out), size/2, seed, bufSize)
+	default:
+		return writeRandomData(ctx, out, size, seed, bufSize)
+	}
+}
+
+// writeZeroData writes size zero bytes to out, bufSize bytes at a time
+func writeZeroData(ctx context.Context, out io.Writer, size int64, bufSize int) error {
+	buf := make([]byte, bufSize)
+	for size > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := out.Write(buf[:min(int64(len(buf)), size)])
+		if err != nil {
+			return err
+		}
+		size -= int64(n)
+	}
+	return nil
+}
+
+// generateFile writes size bytes of the given generation mode to path, from seed or a random seed
+// when nil, and returns their SHA-256 hash. Content from a given seed was often hashed before, in
+// which case the cached hash is returned and the file is only written. Random files without a seed
+// go through generateRandomFile instead, which can split the work across CPUs.
+func (h *DownloadHandler) generateFile(ctx context.Context, path, generation string, size int64, seed *int64) (string, error) {
+	if generation == GenerationZero && h.sparseZeroFiles() {
+		return h.generateSparseZeroFile(ctx, path, size)
+	}
+
+	f, err := h.createGeneratedFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	bufSize := h.cfg.GenerateBufferKB * 1024
+	if seed == nil {
+		hasher := sha256.New()
+		if err := writeGeneratedData(ctx, io.MultiWriter(f, hasher), generation, size, seedOrNow(nil), bufSize); err != nil {
+			return "", err
+		}
+		if err := f.finish(); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hasher.Sum(nil)), nil
+	}
+
+	key := newSeededKey(generation, size, *seed)
+	if hash, ok := h.cachedSeededHash(key); ok {
+		if err := writeGeneratedData(ctx, f, generation, size, *seed, bufSize); err != nil {
+			return "", err
+		}
+		return hash, f.finish()
+	}
+	hasher := sha256.New()
+	if err := writeGeneratedData(ctx, io.MultiWriter(f, hasher), generation, size, *seed, bufSize); err != nil {
+		return "", err
+	}
+	if err := f.finish(); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	h.cacheSeededHash(key, hash)
+	return hash, nil
+}
+
+// generateSparseZeroFile creates a zero file of size bytes by truncating, so it reads as zeros but
+// takes no disk space, and returns its SHA-256 hash from zeroHash
+func (h *DownloadHandler) generateSparseZeroFile(ctx context.Context, path string, size int64) (string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return "", err
+	}
+	return h.zeroHash(ctx, size)
+}
+
+// zeroHash returns the SHA-256 of size zero bytes: from zeroHashes for the listed sizes, otherwise
+// hashed in memory once and then cached
+func (h *DownloadHandler) zeroHash(ctx context.Context, size int64) (string, error) {
+	if hash, ok := zeroHashes[size]; ok {
+		return hash, nil
+	}
+	// Zero data doesn't depend on a seed; this is also the key a dry run uses
+	key := newSeededKey(GenerationZero, size, dryRunSeed)
+	if hash, ok := h.cachedSeededHash(key); ok {
+		return hash, nil
+	}
+	hasher := sha256.New()
+	if err := writeZeroData(ctx, hasher, size, h.cfg.GenerateBufferKB*1024); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	h.cacheSeededHash(key, hash)
+	return hash, nil
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// TestZeroHashes checks the built-in hashes of the smaller sizes against real hashes of zeros
+func TestZeroHashes(t *testing.T) {
+	for _, sizeMB := range []int{5, 10, 20} {
+		size := allowedSizes[sizeMB]
+		hasher := sha256.New()
+		if err := writeZeroData(context.Background(), hasher, size, 1024*1024); err != nil {
+			t.Fatal(err)
+		}
+		if want := hex.EncodeToString(hasher.Sum(nil)); zeroHashes[size] != want {
+			t.Errorf("zeroHashes[%d MB] = %s, want %s", sizeMB, zeroHashes[size], want)
+		}
+	}
+	for sizeMB, size := range sparseSizes {
+		if _, ok := zeroHashes[size]; !ok {
+			t.Errorf("no zero hash for sparse size %d MB", sizeMB)
+		}
+	}
+}
+
+func TestSparseSizesNeedZeroGeneration(t *testing.T) {
+	h := newTestHandler(t)
+	tests := []struct {
+		req    DownloadInitRequest
+		wantOK bool
+	}{
+		{DownloadInitRequest{SizeMB: 10000, Generation: GenerationZero}, true},
+		{DownloadInitRequest{SizeMB: 10000}, false},
+		{DownloadInitRequest{SizeMB: 10000, Generation: GenerationRandom}, false},
+		{DownloadInitRequest{SizeMB: 10000, Generation: GenerationZero, Compressible: true}, false},
+		{DownloadInitRequest{SizeMB: 3000, Generation: GenerationZero}, false},
+	}
+	for _, tt := range tests {
+		if _, ok := h.requestedSize(tt.req); ok != tt.wantOK {
+			t.Errorf("requestedSize(%+v) ok = %v, want %v", tt.req, ok, tt.wantOK)
+		}
+	}
+
+	h.cfg.FsyncFiles = true
+	if _, ok := h.requestedSize(DownloadInitRequest{SizeMB: 10000, Generation: GenerationZero}); ok {
+		t.Error("sparse size allowed with fsync_files")
+	}
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"log"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// openGeoIP opens the MaxMind GeoLite2/GeoIP2 City database at path. Geolocation is optional, so a
+// missing or unreadable database is logged and nil returned, leaving results without locations.
+func openGeoIP(path string) *geoip2.Reader {
+	if path == "" {
+		return nil
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		log.Printf("GeoIP database %s unavailable, results will not be geolocated: %v", path, err)
+		return nil
+	}
+	return db
+}
+
+// locate returns the country ISO code and English city name for a client IP. Both are empty when
+// no database is loaded or the address isn't in it.
+func (h *DownloadHandler) locate(clientIP string) (country, city string) {
+	if h.geo == nil {
+		return "", ""
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return "", ""
+	}
+	record, err := h.geo.City(ip)
+	if err != nil {
+		return "", ""
+	}
+	return record.Country.IsoCode, record.City.Names["en"]
+}
+
+// Close releases the GeoIP database, if one is open. Call it once the server has stopped serving.
+func (h *DownloadHandler) Close() error {
+	if h.geo == nil {
+		return nil
+	}
+	return h.geo.Close()
+}
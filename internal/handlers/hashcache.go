@@ -0,0 +1,73 @@
+package handlers
+
+import "time"
+
+const (
+	// seededHashTTL is how long the hash of seeded content is reused after it was computed
+	seededHashTTL = time.Hour
+	// maxSeededHashes bounds the cache; the entry closest to expiring makes way for a new one
+	maxSeededHashes = 1024
+)
+
+// seededKey identifies content that depends only on its generation mode, size and seed, so it hashes
+// the same every time it is generated
+type seededKey struct {
+	generation string
+	size       int64
+	seed       int64
+}
+
+func newSeededKey(generation string, size, seed int64) seededKey {
+	if isRandomGeneration(generation) {
+		generation = GenerationRandom
+	}
+	return seededKey{generation: generation, size: size, seed: seed}
+}
+
+type seededHash struct {
+	hash    string
+	expires time.Time
+}
+
+// cachedSeededHash returns the SHA-256 of the content for key if it was computed within
+// seededHashTTL, saving seeded inits and dry runs from hashing the same bytes again. The caller must
+// not hold h.mu.
+func (h *DownloadHandler) cachedSeededHash(key seededKey) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.seededHashes[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.hash, true
+}
+
+// cacheSeededHash remembers the hash of the content for key. The caller must not hold h.mu.
+func (h *DownloadHandler) cacheSeededHash(key seededKey, hash string) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.seededHashes[key]; !ok && len(h.seededHashes) >= maxSeededHashes {
+		h.evictSeededHashes(now)
+		if len(h.seededHashes) >= maxSeededHashes {
+			var oldest seededKey
+			var oldestExpires time.Time
+			for k, entry := range h.seededHashes {
+				if oldestExpires.IsZero() || entry.expires.Before(oldestExpires) {
+					oldest, oldestExpires = k, entry.expires
+				}
+			}
+			delete(h.seededHashes, oldest)
+		}
+	}
+	h.seededHashes[key] = seededHash{hash: hash, expires: now.Add(seededHashTTL)}
+}
+
+// evictSeededHashes drops expired seeded hashes. The caller must hold h.mu.
+func (h *DownloadHandler) evictSeededHashes(now time.Time) {
+	for key, entry := range h.seededHashes {
+		if now.After(entry.expires) {
+			delete(h.seededHashes, key)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// errHashBusy is returned when no hashing slot freed up within HashWait
+var errHashBusy = errors.New("timed out waiting for a hashing slot")
+
+// acquireHashSlot waits until fewer than MaxHashers files are being read back and hashed, for
+// verification or block hashes, and takes a slot. Rehashing a large file keeps a CPU busy for
+// seconds, so bursts of verifies queue instead of starving everything else. On failure it writes
+// the error response itself: 503 once HashWait has passed. The returned function gives the slot back.
+func (h *DownloadHandler) acquireHashSlot(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, err := acquireSlot(r.Context(), h.hashSlots, h.cfg.HashWait, errHashBusy)
+	switch {
+	case err == nil:
+		return release, true
+	case errors.Is(err, context.Canceled):
+		log.Printf("Client closed request while waiting for a hashing slot")
+		w.WriteHeader(StatusClientClosedRequest)
+	default:
+		writeJSONError(w, http.StatusServiceUnavailable, CodeServerBusy, "Too many files are being hashed. Try again later.")
+	}
+	return nil, false
+}
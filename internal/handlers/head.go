@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// payloadETag is the strong ETag of a file served as is, derived from its SHA-256
+func payloadETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// headData answers HEAD /download/data with the headers a GET would carry, so clients can learn the
+// size and ETag of a payload without transferring it. Nothing is measured or recorded, and the
+// session stays as it was. Timed sessions have neither a length nor a stable hash to report, and
+// diskless ones have no stable hash. compressible is the session's, read by the caller under h.mu.
+func (h *DownloadHandler) headData(w http.ResponseWriter, r *http.Request, sess *Session, compressible *CompressiblePayload) {
+	payload, ok := parsePayload(w, r, compressible)
+	if !ok {
+		return
+	}
+
+	setPayloadHeaders(w.Header())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	h.setResponseHeaders(w.Header())
+
+	if sess.Duration == 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(sess.FileSize, 10))
+	}
+	if sess.Duration == 0 && !sess.Diskless {
+		hash := sess.ExpectedHash
+		if payload != nil {
+			hash = payload.ExpectedHash
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", payloadETag(hash))
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+)
+
+// IdempotencyKeyHeader lets clients retry an init without creating a second session
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyEntry is a key's claim on a session. While the first request with the key is still
+// creating its session, done is open and sessionID empty; retries wait on done.
+type idempotencyEntry struct {
+	sessionID string
+	expiresAt time.Time
+	done      chan struct{}
+}
+
+// idempotencyScope namespaces a key by client IP so one client can't claim another's session by
+// guessing its key
+func idempotencyScope(r *http.Request, key string) string {
+	return getClientIP(r) + "|" + key
+}
+
+// claimIdempotent returns the session created earlier for the request's Idempotency-Key, if the key
+// is still live and its session still exists. A retry that arrives while the first request is
+// still generating waits for it and shares its session. Otherwise the key is reserved for this
+// request, and finish must be called with the session it created, or "" if it failed, which frees
+// the key for the next retry. Without a key, finish does nothing. The error is the request's own,
+// when it was cancelled while waiting.
+func (h *DownloadHandler) claimIdempotent(r *http.Request) (sessionID string, sess *Session, finish func(string), err error) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		return "", nil, func(string) {}, nil
+	}
+	scope := idempotencyScope(r, key)
+
+	h.mu.Lock()
+	for {
+		entry, ok := h.idempotencyKeys[scope]
+		if !ok || (entry.sessionID != "" && time.Now().After(entry.expiresAt)) {
+			break
+		}
+		if entry.sessionID == "" {
+			// The first request is still creating its session
+			h.mu.Unlock()
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return "", nil, nil, r.Context().Err()
+			}
+			h.mu.Lock()
+			continue
+		}
+		if sess, _ := h.findSession(entry.sessionID); sess != nil {
+			h.mu.Unlock()
+			return entry.sessionID, sess, nil, nil
+		}
+		break
+	}
+
+	entry := &idempotencyEntry{done: make(chan struct{})}
+	h.idempotencyKeys[scope] = entry
+	h.mu.Unlock()
+
+	finish = func(sessionID string) {
+		h.mu.Lock()
+		if sessionID == "" {
+			delete(h.idempotencyKeys, scope)
+		} else {
+			entry.sessionID = sessionID
+			entry.expiresAt = time.Now().Add(h.cfg.IdempotencyTTL)
+		}
+		h.mu.Unlock()
+		close(entry.done)
+	}
+	return "", nil, finish, nil
+}
+
+// evictIdempotencyKeys drops expired keys; keys whose session is still being created stay. The
+// caller must hold h.mu.
+func (h *DownloadHandler) evictIdempotencyKeys(now time.Time) {
+	for key, entry := range h.idempotencyKeys {
+		if entry.sessionID != "" && now.After(entry.expiresAt) {
+			delete(h.idempotencyKeys, key)
+		}
+	}
+}
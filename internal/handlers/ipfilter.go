@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// IPFilter refuses requests from client IPs outside an allowlist or inside a denylist, both lists
+// of CIDRs. The lists can be replaced while the server runs, e.g. on SIGHUP.
+type IPFilter struct {
+	lists  atomic.Pointer[ipLists]
+	exempt []string
+}
+
+type ipLists struct {
+	allow []netip.Prefix // Empty allows every address not denied
+	deny  []netip.Prefix
+}
+
+// NewIPFilter parses comma-separated allow and deny CIDR lists. Paths in exempt, such as health
+// checks, are never refused.
+func NewIPFilter(allow, deny string, exempt ...string) (*IPFilter, error) {
+	f := &IPFilter{exempt: exempt}
+	if err := f.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Update swaps in new allow and deny lists. On error the current lists stay in force.
+func (f *IPFilter) Update(allow, deny string) error {
+	allowList, err := parseCIDRList(allow)
+	if err != nil {
+		return fmt.Errorf("allow_cidrs: %w", err)
+	}
+	denyList, err := parseCIDRList(deny)
+	if err != nil {
+		return fmt.Errorf("deny_cidrs: %w", err)
+	}
+	f.lists.Store(&ipLists{allow: allowList, deny: denyList})
+	return nil
+}
+
+// Middleware answers 403 to clients the lists refuse. Clients are judged by the connection's peer
+// address; only with trusted proxies configured in ClientIP, which must run first, is the address
+// taken from X-Forwarded-For, so a client can't talk its way past the lists with its own header.
+// Behind a proxy that isn't configured as trusted, every request is judged as the proxy's.
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(f.exempt, r.URL.Path) && !f.allowed(getClientIP(r)) {
+			writeJSONError(w, http.StatusForbidden, CodeForbidden, "Access denied")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowed reports whether ip may use the server. The denylist wins over the allowlist. An address
+// that doesn't parse matches neither list, so it is only refused when there is an allowlist.
+func (f *IPFilter) allowed(ip string) bool {
+	lists := f.lists.Load()
+	if len(lists.allow) == 0 && len(lists.deny) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(ip, "[]"))
+	if err != nil {
+		return len(lists.allow) == 0
+	}
+	addr = addr.Unmap().WithZone("") // ::ffff:10.0.0.1 matches 10.0.0.0/8
+	if containsAddr(lists.deny, addr) {
+		return false
+	}
+	return len(lists.allow) == 0 || containsAddr(lists.allow, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs; a bare address stands for itself alone
+func parseCIDRList(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			addr = addr.Unmap().WithZone("")
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxKeepalives caps how often one session can be extended, so it can't be pinned indefinitely
+const maxKeepalives = 10
+
+type KeepaliveResponse struct {
+	SessionID      string    `json:"session_id"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	KeepalivesLeft int       `json:"keepalives_left"`
+}
+
+// Keepalive extends a session by a full SessionTTL from now, for long interactive tests that would
+// otherwise outlive it. Each session may be extended at most maxKeepalives times.
+func (h *DownloadHandler) Keepalive(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["session_id"]
+
+	h.mu.Lock()
+	sess, status := h.findSession(sessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
+		return
+	}
+	if sess.Keepalives >= maxKeepalives {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, CodeKeepaliveLimit, "Keepalive limit reached for this session")
+		return
+	}
+	sess.Keepalives++
+	sess.LastSeen = time.Now()
+	resp := KeepaliveResponse{
+		SessionID:      sessionID,
+		ExpiresAt:      h.sessionExpiry(sess),
+		KeepalivesLeft: maxKeepalives - sess.Keepalives,
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
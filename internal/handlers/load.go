@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// loadRetryAfter is what Retry-After tells clients refused for load. The 1-minute average takes
+// about that long to move noticeably.
+const loadRetryAfter = 30 * time.Second
+
+// checkLoad refuses the request with 503 and Retry-After while the 1-minute load average is above
+// MaxLoadAverage, so the speed test backs off on a busy shared host. It writes the error response
+// itself and returns false when the request should not go ahead.
+func (h *DownloadHandler) checkLoad(w http.ResponseWriter) bool {
+	if h.cfg.MaxLoadAverage <= 0 {
+		return true
+	}
+	load, err := readLoadAverage()
+	if err != nil {
+		// Failing open; a broken check shouldn't take the server down with it
+		log.Printf("Error reading load average: %v", err)
+		return true
+	}
+	if load <= h.cfg.MaxLoadAverage {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(loadRetryAfter/time.Second)))
+	writeJSONError(w, http.StatusServiceUnavailable, CodeServerBusy, fmt.Sprintf("Server is under load (%.2f). Try again later.", load))
+	return false
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readLoadAverage returns the 1-minute load average from /proc/loadavg
+func readLoadAverage() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/loadavg contents %q", data)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
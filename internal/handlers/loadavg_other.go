@@ -0,0 +1,10 @@
+//go:build !linux
+
+package handlers
+
+import "errors"
+
+// readLoadAverage is only implemented on Linux
+func readLoadAverage() (float64, error) {
+	return 0, errors.New("load average is only available on Linux")
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the ID used to correlate a request's log lines
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds client-supplied request IDs before they are echoed and logged
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	clientIPKey
+	connKey
+)
+
+// RequestID gives every request an ID, reusing a reasonable client-supplied X-Request-ID, stores
+// it in the request context and echoes it in the response
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.New().String()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// requestIDFrom returns the ID assigned by RequestID, or "-" outside of it
+func requestIDFrom(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// ClientIP resolves the client's address once per request and stores it in the request context for
+// getClientIP. With trustedProxies > 0, that many proxies are trusted to append to X-Forwarded-For,
+// so the client is the entry that many hops from the right; entries further left are whatever the
+// client chose to send. With 0, X-Forwarded-For is ignored and the connection's address is used.
+func ClientIP(trustedProxies int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := resolveClientIP(r, trustedProxies)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ip)))
+		})
+	}
+}
+
+// Recover turns a handler panic into a logged stack trace and a clean JSON 500, instead of a
+// dropped connection
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				// Deliberate abort; let net/http close the connection quietly
+				panic(rec)
+			}
+
+			log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestIDFrom(r.Context()), rec, debug.Stack())
+			writeJSONError(w, http.StatusInternalServerError, CodeInternal, "internal")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitInFlight caps how many requests are served at once, across all clients, so a flood of
+// connections can't exhaust memory or file descriptors. Requests beyond limit are refused straight
+// away with 503 and Retry-After rather than queued. Paths in exempt, such as health checks, are
+// neither counted nor refused. limit <= 0 disables it.
+func LimitInFlight(limit int, exempt ...string) func(http.Handler) http.Handler {
+	// mux applies middleware anew for every request, so the slots must be shared from out here
+	slots := make(chan struct{}, max(limit, 0))
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(w, r)
+			default:
+				w.Header().Set("Retry-After", "1")
+				writeJSONError(w, http.StatusServiceUnavailable, CodeServerBusy, "Too many requests in flight. Try again later.")
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sync/atomic"
+)
+
+// maxUploadParts bounds how many parts are listed in an upload response; further parts are still
+// read and counted
+const maxUploadParts = 100
+
+// UploadPart describes one part of a multipart/form-data upload
+type UploadPart struct {
+	Name     string `json:"name,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256"`
+}
+
+// multipartBoundary returns the boundary of a multipart/form-data request, or "" for any other body
+func multipartBoundary(r *http.Request) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// discardMultipart reads a multipart body part by part, hashing each part's content on its way to
+// io.Discard so nothing is buffered beyond the part headers. Parts are read raw, so the sizes and
+// hashes are of the bytes as sent, even for a part marked Content-Transfer-Encoding:
+// quoted-printable. It returns the bytes read from body, boundaries and headers included, since
+// those crossed the network too.
+func discardMultipart(body io.Reader, boundary string) (int64, []UploadPart, error) {
+	var received atomic.Int64
+	mr := multipart.NewReader(&progressReader{Reader: body, n: &received}, boundary)
+
+	var parts []UploadPart
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return received.Load(), parts, nil
+		}
+		if err != nil {
+			return received.Load(), parts, err
+		}
+
+		hasher := sha256.New()
+		n, err := io.Copy(hasher, part)
+		part.Close()
+		if err != nil {
+			return received.Load(), parts, err
+		}
+		if len(parts) < maxUploadParts {
+			parts = append(parts, UploadPart{
+				Name:     part.FormName(),
+				Filename: part.FileName(),
+				Bytes:    n,
+				SHA256:   hex.EncodeToString(hasher.Sum(nil)),
+			})
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// TestDiscardMultipartReadsRawParts checks that a quoted-printable part is counted and hashed as
+// sent rather than decoded
+func TestDiscardMultipartReadsRawParts(t *testing.T) {
+	const content = "a=3Db=\r\nc"
+	body := "--XYZ\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"f.txt\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" + content + "\r\n" +
+		"--XYZ--\r\n"
+
+	received, parts, err := discardMultipart(strings.NewReader(body), "XYZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != int64(len(body)) {
+		t.Errorf("received %d bytes, want %d", received, len(body))
+	}
+	if len(parts) != 1 {
+		t.Fatalf("got %d parts, want 1", len(parts))
+	}
+	sum := sha256.Sum256([]byte(content))
+	if p := parts[0]; p.Bytes != int64(len(content)) || p.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("part = %+v, want %d bytes hashing to %x", p, len(content), sum)
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sweepOrphanedFiles deletes generated files in the data directories that no session, shared file or
+// pool entry references, such as those left behind by a crash. At startup, before anything has been
+// generated, every unreferenced file is an orphan. While running, a file is only deleted once it is
+// older than SessionTTL and was already unreferenced on the previous sweep, so files between being
+// generated (or taken from the pool) and being registered are never touched.
+func (h *DownloadHandler) sweepOrphanedFiles(startup bool) {
+	now := time.Now()
+	files := h.generatedFiles()
+
+	h.mu.Lock()
+	referenced := h.referencedFiles()
+	h.mu.Unlock()
+
+	unreferenced := make(map[string]bool)
+	for path, modTime := range files {
+		if referenced[path] {
+			continue
+		}
+		if !startup {
+			if now.Sub(modTime) < h.cfg.SessionTTL {
+				continue
+			}
+			unreferenced[path] = true
+			if !h.orphanCandidates[path] {
+				continue
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing orphaned file %s: %v", path, err)
+			continue
+		}
+		log.Printf("Removed orphaned file %s", path)
+	}
+	h.orphanCandidates = unreferenced
+}
+
+// generatedFiles lists the files the server generated in its data directories, including the pool,
+// with their modification times. Anything not named like a generated file is left out.
+func (h *DownloadHandler) generatedFiles() map[string]time.Time {
+	dirs := append([]string{filepath.Join(h.dataDirs[0], "pool")}, h.dataDirs...)
+	files := make(map[string]time.Time)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue // The pool directory only exists when the pool was ever enabled
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || !isGeneratedName(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			path, err := filepath.Abs(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			files[path] = info.ModTime()
+		}
+	}
+	return files
+}
+
+// isGeneratedName reports whether name looks like a file the server generates: a .bin file whose
+// name ends in a UUID, optionally after a prefix such as "compressible-" or "shared-<size>-"
+func isGeneratedName(name string) bool {
+	stem, ok := strings.CutSuffix(name, ".bin")
+	if !ok || len(stem) < 36 {
+		return false
+	}
+	_, err := uuid.Parse(stem[len(stem)-36:])
+	return err == nil
+}
+
+// referencedFiles returns the paths of every file in use by a session, shared file or the pool. The
+// caller must hold h.mu.
+func (h *DownloadHandler) referencedFiles() map[string]bool {
+	referenced := make(map[string]bool)
+	for _, sess := range h.sessions {
+		if sess.FilePath != "" {
+			referenced[sess.FilePath] = true
+		}
+		if sess.Compressible != nil {
+			referenced[sess.Compressible.FilePath] = true
+		}
+	}
+	for _, sf := range h.sharedFiles {
+		referenced[sf.path] = true
+	}
+	if h.pool != nil {
+		h.pool.mu.Lock()
+		for _, files := range h.pool.ready {
+			for _, pf := range files {
+				referenced[pf.path] = true
+			}
+		}
+		h.pool.mu.Unlock()
+	}
+	return referenced
+}
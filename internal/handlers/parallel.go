@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// parallelGenerateMinSize is the smallest file worth generating in parallel. Below it the
+	// extra pass to hash the file costs more than the concurrency saves.
+	parallelGenerateMinSize = 100 * 1024 * 1024
+	// maxGenerateWorkers bounds the goroutines generating one file
+	maxGenerateWorkers = 8
+)
+
+// generateWorkers is how many goroutines generate a file of the given size
+func generateWorkers(size int64) int {
+	if size < parallelGenerateMinSize {
+		return 1
+	}
+	return min(runtime.GOMAXPROCS(0), maxGenerateWorkers)
+}
+
+// generateRandomFileParallel fills a file of the given size using workers goroutines, each writing
+// its own region with WriteAt (so nothing shares the file offset) from its own seeded PRNG. The
+// assembled file is then read back to compute its SHA-256 hash, so the hash always matches the
+// bytes that will be served. It stops early and returns the context's error if ctx is cancelled.
+func (h *DownloadHandler) generateRandomFileParallel(ctx context.Context, path string, size int64, workers int) (string, error) {
+	g, err := h.createGeneratedFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer g.Close()
+	f := g.f // Never opened for direct I/O, so the regions can be written to it directly
+
+	if err := f.Truncate(size); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunk := (size + int64(workers) - 1) / int64(workers)
+	seed := time.Now().UnixNano()
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		offset := int64(i) * chunk
+		length := min(chunk, size-offset)
+		if length <= 0 {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out := io.NewOffsetWriter(f, offset)
+			if errs[i] = writeRandomData(ctx, out, length, seed+int64(i), h.cfg.GenerateBufferKB*1024); errs[i] != nil {
+				cancel() // No point finishing the other regions
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := g.finish(); err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(f, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// Payloads a session can serve, chosen with DownloadData's payload parameter
+const (
+	PayloadRandom       = "random"
+	PayloadCompressible = "compressible"
+)
+
+// CompressiblePayload is the second file of a session initialised with compressible, and the result
+// of its last download. It is the same size as the session's random file.
+type CompressiblePayload struct {
+	FilePath          string
+	ExpectedHash      string
+	DownloadSpeedMbps float64
+	DownloadStatus    string
+	BytesTransferred  int64
+	CompressionRatio  float64 // Payload over wire bytes when the last download was gzipped, else 0
+}
+
+// PayloadSpeed reports the last download of a session's compressible payload
+type PayloadSpeed struct {
+	DownloadSpeedMbps float64 `json:"download_speed_mbps"`
+	Status            string  `json:"status"`
+	BytesTransferred  int64   `json:"bytes_transferred"`
+	CompressionRatio  float64 `json:"compression_ratio,omitempty"`
+}
+
+// prepareCompressibleFile generates a compressible file of size bytes from seed (a random one when
+// nil), once a generation slot is free. The file is removed again if anything fails.
+func (h *DownloadHandler) prepareCompressibleFile(ctx context.Context, size int64, seed *int64) (*CompressiblePayload, error) {
+	path, err := h.dataPath(h.pickDataDir(), "compressible-"+uuid.New().String()+".bin")
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := h.acquireGenerationSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	expectedHash, err := h.generateFile(ctx, path, GenerationCompressible, size, seed)
+	if err != nil {
+		log.Printf("Error generating compressible file: %v", err)
+		os.Remove(path)
+		return nil, err
+	}
+	return &CompressiblePayload{FilePath: path, ExpectedHash: expectedHash}, nil
+}
+
+// parsePayload reads DownloadData's payload parameter and returns the compressible payload to serve,
+// or nil for the session's main file. compressible is the session's, read by the caller under h.mu.
+// On failure it writes the error response itself and returns false.
+func parsePayload(w http.ResponseWriter, r *http.Request, compressible *CompressiblePayload) (*CompressiblePayload, bool) {
+	switch r.URL.Query().Get("payload") {
+	case "", PayloadRandom:
+		return nil, true
+	case PayloadCompressible:
+		if compressible == nil {
+			writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "Session was not initialised with compressible")
+			return nil, false
+		}
+		return compressible, true
+	default:
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "payload must be one of random, compressible")
+		return nil, false
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxPingSamples bounds how many RTT samples are kept per session
+	maxPingSamples = 100
+	// maxPingGap is the longest gap between two pings that still counts as one round trip
+	maxPingGap = 5 * time.Second
+)
+
+type PingResponse struct {
+	ServerTimeNs int64 `json:"server_time_ns"`
+	ServerRecvNs int64 `json:"server_recv_ns"` // When the ping was taken in, after any simulated delay
+	ServerSendNs int64 `json:"server_send_ns"` // When the pong was about to be written
+}
+
+// Ping answers immediately so clients can time round trips. When a session_id is given, the server
+// also times the gap between its previous pong and the next ping, which for a client pinging
+// back-to-back is one full round trip, and records it on the session. Pings that arrive while a
+// download is running on the session are kept apart as loaded samples, which expose bufferbloat.
+// The receive and send timestamps let a client subtract the server's own time from the round trip
+// and estimate clock skew as ((recv - t0) + (send - t1)) / 2.
+func (h *DownloadHandler) Ping(w http.ResponseWriter, r *http.Request) {
+	h.simulateDelay(r)
+	receivedAt := time.Now()
+
+	if sessionID := r.URL.Query().Get("session_id"); sessionID != "" {
+		h.mu.Lock()
+		sess, status := h.findSession(sessionID)
+		if sess == nil {
+			h.mu.Unlock()
+			writeSessionError(w, status)
+			return
+		}
+		if msg := enterPhase(sess, PhasePing); msg != "" {
+			h.mu.Unlock()
+			writeJSONError(w, http.StatusConflict, CodePhaseOutOfOrder, msg)
+			return
+		}
+
+		if gap := receivedAt.Sub(sess.lastPingAt); !sess.lastPingAt.IsZero() && gap < maxPingGap {
+			samples := &sess.PingSamples
+			if sess.activeDownloads > 0 {
+				samples = &sess.LoadedPingSamples
+			}
+			if len(*samples) < maxPingSamples {
+				*samples = append(*samples, float64(gap)/float64(time.Millisecond))
+			}
+		}
+		sess.lastPingAt = time.Now()
+		h.mu.Unlock()
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	sentAt := time.Now().UnixNano()
+	json.NewEncoder(w).Encode(PingResponse{
+		ServerTimeNs: sentAt,
+		ServerRecvNs: receivedAt.UnixNano(),
+		ServerSendNs: sentAt,
+	})
+}
+
+// minPingMs returns the lowest recorded RTT, which is the one least affected by queuing
+func minPingMs(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	lowest := samples[0]
+	for _, s := range samples[1:] {
+		if s < lowest {
+			lowest = s
+		}
+	}
+	return lowest
+}
+
+// simulateDelay sleeps for the request's delay_ms parameter, capped at the configured maximum, to
+// mimic a distant server. It does nothing unless delays are enabled in config.
+func (h *DownloadHandler) simulateDelay(r *http.Request) {
+	delay := h.responseDelay(r)
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+	}
+}
+
+// responseDelay returns the request's delay_ms parameter capped at the configured maximum, or 0
+// when delays are disabled or none was asked for
+func (h *DownloadHandler) responseDelay(r *http.Request) time.Duration {
+	if h.cfg.MaxResponseDelay <= 0 {
+		return 0
+	}
+	ms, err := strconv.Atoi(r.URL.Query().Get("delay_ms"))
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return min(time.Duration(ms)*time.Millisecond, h.cfg.MaxResponseDelay)
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type pooledFile struct {
+	path string
+	hash string
+}
+
+// filePool keeps pre-generated files with precomputed hashes ready for every allowed size, so that
+// InitDownload can hand one out instead of generating and hashing on the request path. Handed-out
+// files are replaced in the background.
+type filePool struct {
+	h      *DownloadHandler
+	dir    string
+	target int // Files to keep ready per size
+
+	mu     sync.Mutex
+	ready  map[int64][]pooledFile
+	refill chan int64
+}
+
+func newFilePool(h *DownloadHandler, target int) *filePool {
+	return &filePool{
+		h:      h,
+		dir:    filepath.Join(h.dataDirs[0], "pool"),
+		target: target,
+		ready:  make(map[int64][]pooledFile),
+		refill: make(chan int64, len(allowedSizes)*target),
+	}
+}
+
+// start fills the pool for every allowed size in the background
+func (p *filePool) start() {
+	if err := os.MkdirAll(p.dir, 0o755); err != nil {
+		log.Printf("Error creating pool directory: %v", err)
+	}
+	go func() {
+		for size := range p.refill {
+			p.fill(size)
+		}
+	}()
+	for _, size := range allowedSizes {
+		p.requestRefill(size)
+	}
+}
+
+// take moves a ready file of the given size to dest and returns its hash. It reports false if the
+// pool is disabled or has nothing ready for that size.
+func (p *filePool) take(size int64, dest string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+
+	p.mu.Lock()
+	files := p.ready[size]
+	if len(files) == 0 {
+		p.mu.Unlock()
+		p.requestRefill(size)
+		return "", false
+	}
+	pf := files[len(files)-1]
+	p.ready[size] = files[:len(files)-1]
+	p.mu.Unlock()
+
+	p.requestRefill(size)
+
+	if err := os.Rename(pf.path, dest); err != nil {
+		log.Printf("Error moving pooled file %s: %v", pf.path, err)
+		os.Remove(pf.path)
+		return "", false
+	}
+	return pf.hash, true
+}
+
+// requestRefill asks the background filler to top up the given size without blocking the caller
+func (p *filePool) requestRefill(size int64) {
+	select {
+	case p.refill <- size:
+	default:
+		// A refill is already queued and will top the pool up to target
+	}
+}
+
+// fill generates files until the pool holds target files of the given size
+func (p *filePool) fill(size int64) {
+	for {
+		p.mu.Lock()
+		have := len(p.ready[size])
+		p.mu.Unlock()
+		if have >= p.target {
+			return
+		}
+
+		path, err := p.h.dataPath(p.dir, uuid.New().String()+".bin")
+		if err != nil {
+			log.Printf("Error refilling pool for %d bytes: %v", size, err)
+			return
+		}
+		hash, err := p.h.prepareFile(context.Background(), path, size, nil, GenerationRandom)
+		if err != nil {
+			log.Printf("Error refilling pool for %d bytes: %v", size, err)
+			return
+		}
+
+		p.mu.Lock()
+		p.ready[size] = append(p.ready[size], pooledFile{path: path, hash: hash})
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DownloadRaw streams size_mb of freshly generated random data without a session or a file behind
+// it, for clients that only want a throughput figure and don't verify a hash. The speed is only
+// reported in the result trailers, since nothing is kept to query it by afterwards.
+func (h *DownloadHandler) DownloadRaw(w http.ResponseWriter, r *http.Request) {
+	sizeMB, err := queryInt(r, "size_mb")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "size_mb must be an integer")
+		return
+	}
+	size, ok := allowedSizes[sizeMB]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidSize, invalidSizeMessage())
+		return
+	}
+	if !h.checkLoad(w) {
+		return
+	}
+	// Generating on the fly costs as much as an init of the same size, so it is charged like one
+	if !h.checkRateLimit(w, r, initCostMB(DownloadInitRequest{SizeMB: sizeMB})) {
+		return
+	}
+
+	r, endTransfer := h.capTransfer(w, r, size, "Raw download")
+	defer endTransfer()
+
+	setPayloadHeaders(w.Header())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	h.setResponseHeaders(w.Header())
+	trailers := wantsTrailers(r)
+	if trailers {
+		declareResultTrailers(w.Header())
+	}
+	// As in DownloadData, HTTP/1.1 only carries trailers on chunked responses
+	if !trailers || r.ProtoMajor >= 2 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	setTransferDeadline(w, h.transferTimeAllowed(size))
+
+	// Start tracking time
+	startTime := time.Now()
+
+	cw := &countingWriter{ResponseWriter: h.throttle(w, r)}
+	err = writeRandomData(r.Context(), cw, size, startTime.UnixNano(), h.cfg.GenerateBufferKB*1024)
+
+	// End tracking time
+	elapsed := time.Since(startTime)
+
+	h.recordBytesSent(getClientIP(r), cw.written)
+
+	if err != nil {
+		outcome := downloadOutcome(r, err)
+		h.recordDownloadOutcome(outcome)
+		log.Printf("Raw download %s after %d bytes: %v", outcome, cw.written, err)
+		return
+	}
+	h.recordDownloadOutcome(DownloadComplete)
+
+	speedMbps := computeSpeedMbps(cw.written, elapsed)
+	traceTransfer(r.Context(), cw.written, speedMbps)
+	if trailers {
+		setResultTrailers(w.Header(), speedMbps, cw.written)
+	}
+
+	log.Printf("Raw download: %d bytes in %s, %.2f Mbps over %s", cw.written, elapsed, speedMbps, r.Proto)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// reverseDNSTimeout bounds each lookup, so a slow resolver only delays the hostname, never a request
+	reverseDNSTimeout = 2 * time.Second
+	// reverseDNSTTL is how long a lookup, failed ones included, is reused
+	reverseDNSTTL = time.Hour
+)
+
+type hostnameEntry struct {
+	name    string // Empty while the lookup runs, or when it failed
+	expires time.Time
+}
+
+// resolveHostname starts a reverse DNS lookup of a client IP in the background, unless reverse DNS
+// is disabled or the IP is already cached. Requests never wait for it; hostname reports the result
+// once it's in. The caller must not hold h.mu.
+func (h *DownloadHandler) resolveHostname(clientIP string) {
+	if !h.cfg.ReverseDNS {
+		return
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	if entry, ok := h.hostnames[clientIP]; ok && now.Before(entry.expires) {
+		h.mu.Unlock()
+		return
+	}
+	// Claim the entry so concurrent inits from the same client don't all look it up
+	h.hostnames[clientIP] = hostnameEntry{expires: now.Add(reverseDNSTTL)}
+	h.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), reverseDNSTimeout)
+		defer cancel()
+
+		var name string
+		if names, err := net.DefaultResolver.LookupAddr(ctx, clientIP); err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+
+		h.mu.Lock()
+		h.hostnames[clientIP] = hostnameEntry{name: name, expires: time.Now().Add(reverseDNSTTL)}
+		h.mu.Unlock()
+	}()
+}
+
+// hostname returns the cached reverse DNS name of a client IP, or "" if there is none (yet). The
+// caller must hold h.mu.
+func (h *DownloadHandler) hostname(clientIP string) string {
+	return h.hostnames[clientIP].name
+}
+
+// evictHostnames drops expired reverse DNS entries. The caller must hold h.mu.
+func (h *DownloadHandler) evictHostnames(now time.Time) {
+	for ip, entry := range h.hostnames {
+		if now.After(entry.expires) {
+			delete(h.hostnames, ip)
+		}
+	}
+}
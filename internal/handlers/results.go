@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Result statuses
+const (
+	ResultVerified        = "verified"
+	ResultVerifiedPartial = "verified_partial" // Only the leading verify_bytes were checked; the session stays open
+	ResultHashMismatch    = "hash_mismatch"
+	ResultSizeMismatch    = "size_mismatch"
+)
+
+// Result is the outcome of one verification, kept in a bounded history for /results and /summary
+type Result struct {
+	Timestamp         time.Time         `json:"timestamp"`
+	SessionID         string            `json:"session_id"`
+	ClientIP          string            `json:"client_ip"`
+	SizeBytes         int64             `json:"size_bytes"`
+	BytesTransferred  int64             `json:"bytes_transferred"`
+	DownloadSpeedMbps float64           `json:"download_speed_mbps"`
+	Status            string            `json:"status"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	Country           string            `json:"country,omitempty"` // ISO code, when a GeoIP database is configured
+	City              string            `json:"city,omitempty"`
+	Hostname          string            `json:"hostname,omitempty"`   // Reverse DNS name, when enabled and resolved in time
+	Unreliable        bool              `json:"unreliable,omitempty"` // Too little was transferred to trust the speed
+}
+
+// resultBuffer is a fixed-capacity ring of results, oldest first
+type resultBuffer struct {
+	items []Result
+	start int
+	count int
+	added uint64 // Results ever added, so the newest one's sequence number is added-1
+}
+
+func newResultBuffer(capacity int) *resultBuffer {
+	return &resultBuffer{items: make([]Result, capacity)}
+}
+
+// add appends a result, overwriting the oldest one once the buffer is full
+func (b *resultBuffer) add(res Result) {
+	if len(b.items) == 0 {
+		return
+	}
+	b.added++
+	if b.count < len(b.items) {
+		b.items[(b.start+b.count)%len(b.items)] = res
+		b.count++
+		return
+	}
+	b.items[b.start] = res
+	b.start = (b.start + 1) % len(b.items)
+}
+
+// evictBefore drops the results recorded before cutoff. Results are added in time order, so they
+// are all at the start of the ring.
+func (b *resultBuffer) evictBefore(cutoff time.Time) {
+	for b.count > 0 && b.items[b.start].Timestamp.Before(cutoff) {
+		b.items[b.start] = Result{}
+		b.start = (b.start + 1) % len(b.items)
+		b.count--
+	}
+}
+
+// evictResults drops results older than ResultMaxAge, if set. The caller must hold h.mu.
+func (h *DownloadHandler) evictResults(now time.Time) {
+	if h.cfg.ResultMaxAge > 0 {
+		h.results.evictBefore(now.Add(-h.cfg.ResultMaxAge))
+	}
+}
+
+// each calls fn for every result from oldest to newest
+func (b *resultBuffer) each(fn func(Result)) {
+	for i := 0; i < b.count; i++ {
+		fn(b.items[(b.start+i)%len(b.items)])
+	}
+}
+
+// oldestSeq returns the sequence number of the oldest retained result; added is one past the newest
+func (b *resultBuffer) oldestSeq() uint64 {
+	return b.added - uint64(b.count)
+}
+
+// at returns the result with sequence number seq, which must be retained
+func (b *resultBuffer) at(seq uint64) Result {
+	return b.items[(b.start+int(seq-b.oldestSeq()))%len(b.items)]
+}
+
+// recordResult appends the outcome of verifying a session to the history. The caller must hold h.mu.
+func (h *DownloadHandler) recordResult(sessionID string, sess *Session, status string) {
+	h.results.add(Result{
+		Timestamp:         time.Now(),
+		SessionID:         sessionID,
+		ClientIP:          sess.ClientIP,
+		SizeBytes:         sess.FileSize,
+		BytesTransferred:  sess.BytesTransferred,
+		DownloadSpeedMbps: sess.DownloadSpeedMbps,
+		Status:            status,
+		Tags:              sess.Tags,
+		Country:           sess.Country,
+		City:              sess.City,
+		Hostname:          h.hostname(sess.ClientIP),
+		Unreliable:        h.unreliable(sess),
+	})
+}
+
+// resultFilter selects results by client IP and time range, then keeps only the last N matches
+type resultFilter struct {
+	clientIP string
+	since    time.Time
+	until    time.Time
+	last     int
+}
+
+// parseResultFilter reads the ip, since, until (RFC 3339) and last query parameters
+func parseResultFilter(r *http.Request) (resultFilter, error) {
+	q := r.URL.Query()
+	f := resultFilter{clientIP: q.Get("ip")}
+
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("since must be an RFC 3339 timestamp")
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf("until must be an RFC 3339 timestamp")
+		}
+	}
+	if v := q.Get("last"); v != "" {
+		if f.last, err = strconv.Atoi(v); err != nil || f.last < 0 {
+			return f, fmt.Errorf("last must be a non-negative integer")
+		}
+	}
+	return f, nil
+}
+
+func (f resultFilter) matches(res Result) bool {
+	if f.clientIP != "" && res.ClientIP != f.clientIP {
+		return false
+	}
+	if !f.since.IsZero() && res.Timestamp.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && res.Timestamp.After(f.until) {
+		return false
+	}
+	return true
+}
+
+// filteredResults returns a copy of the matching results, oldest first
+func (h *DownloadHandler) filteredResults(f resultFilter) []Result {
+	h.mu.Lock()
+	matched := make([]Result, 0, h.results.count)
+	h.results.each(func(res Result) {
+		if f.matches(res) {
+			matched = append(matched, res)
+		}
+	})
+	h.mu.Unlock()
+
+	if f.last > 0 && len(matched) > f.last {
+		matched = matched[len(matched)-f.last:]
+	}
+	return matched
+}
+
+// GetResults lists historical results, optionally filtered by ip, since, until and last
+func (h *DownloadHandler) GetResults(w http.ResponseWriter, r *http.Request) {
+	f, err := parseResultFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.filteredResults(f))
+}
+
+// csvBatchSize is how many results GetResultsCSV looks at per hold of h.mu
+const csvBatchSize = 256
+
+// GetResultsCSV is GetResults as CSV for spreadsheets, with one row per result: timestamp, client IP,
+// size in MB, speed in Mbps and status. The history is walked in batches of csvBatchSize, copying
+// each batch under h.mu and encoding it after letting go, so neither the lock nor memory is held for
+// the whole history. It covers the results retained when the request arrived; any evicted before
+// their batch is reached are left out.
+func (h *DownloadHandler) GetResultsCSV(w http.ResponseWriter, r *http.Request) {
+	f, err := parseResultFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+
+	h.mu.Lock()
+	next, end := h.results.oldestSeq(), h.results.added
+	if f.last > 0 {
+		next = h.results.lastMatchesFrom(f, end)
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="results.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"timestamp", "client_ip", "size_mb", "speed_mbps", "status"})
+	batch := make([]Result, 0, csvBatchSize)
+	for next < end {
+		batch = batch[:0]
+		h.mu.Lock()
+		next = max(next, h.results.oldestSeq())
+		for scanned := 0; next < end && scanned < csvBatchSize; scanned++ {
+			if res := h.results.at(next); f.matches(res) {
+				batch = append(batch, res)
+			}
+			next++
+		}
+		h.mu.Unlock()
+
+		if !writeResultRows(cw, batch) {
+			return // The client went away
+		}
+	}
+	cw.Flush()
+}
+
+// lastMatchesFrom returns the sequence number to start from to get the last f.last results before
+// end that match f
+func (b *resultBuffer) lastMatchesFrom(f resultFilter, end uint64) uint64 {
+	seq, matched := end, 0
+	for seq > b.oldestSeq() && matched < f.last {
+		seq--
+		if f.matches(b.at(seq)) {
+			matched++
+		}
+	}
+	return seq
+}
+
+// writeResultRows writes the CSV rows of results, reporting false once writing has failed
+func writeResultRows(cw *csv.Writer, results []Result) bool {
+	for _, res := range results {
+		cw.Write([]string{
+			res.Timestamp.UTC().Format(time.RFC3339),
+			res.ClientIP,
+			strconv.FormatFloat(float64(res.SizeBytes)/(1024*1024), 'f', -1, 64),
+			strconv.FormatFloat(res.DownloadSpeedMbps, 'f', 2, 64),
+			res.Status,
+		})
+		if cw.Error() != nil {
+			return false
+		}
+	}
+	return true
+}
+
+type SummaryResponse struct {
+	Tests                  int     `json:"tests"`
+	MedianDownloadMbps     float64 `json:"median_download_mbps"`
+	P95DownloadMbps        float64 `json:"p95_download_mbps"`
+	HashFailureRate        float64 `json:"hash_failure_rate"`
+	VerifiedTests          int     `json:"verified_tests"`
+	PartiallyVerifiedTests int     `json:"partially_verified_tests"` // Passed a verify_bytes check; not in the speed figures
+	HashMismatchedTests    int     `json:"hash_mismatched_tests"`
+	SizeMismatchedTests    int     `json:"size_mismatched_tests"` // Rejected on received_bytes before any hash was checked
+}
+
+// GetSummary aggregates historical results, with the same filters as GetResults, so lightweight
+// clients can show trends without downloading the whole history
+func (h *DownloadHandler) GetSummary(w http.ResponseWriter, r *http.Request) {
+	f, err := parseResultFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+
+	results := h.filteredResults(f)
+	resp := SummaryResponse{Tests: len(results)}
+
+	speeds := make([]float64, 0, len(results))
+	for _, res := range results {
+		switch res.Status {
+		case ResultVerified:
+			resp.VerifiedTests++
+			speeds = append(speeds, res.DownloadSpeedMbps)
+		case ResultVerifiedPartial:
+			resp.PartiallyVerifiedTests++
+		case ResultHashMismatch:
+			resp.HashMismatchedTests++
+		case ResultSizeMismatch:
+			resp.SizeMismatchedTests++
+		}
+	}
+	if resp.Tests > 0 {
+		resp.HashFailureRate = float64(resp.HashMismatchedTests) / float64(resp.Tests)
+	}
+	resp.MedianDownloadMbps = median(speeds)
+	resp.P95DownloadMbps = percentile(speeds, 0.95)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// median returns the median of values in O(n) on average. values is reordered.
+func median(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+	upper := selectKth(values, n/2)
+	if n%2 == 1 {
+		return upper
+	}
+	// After selection everything below n/2 is <= upper, so the lower middle is their maximum
+	lower := values[0]
+	for _, v := range values[1 : n/2] {
+		lower = math.Max(lower, v)
+	}
+	return (lower + upper) / 2
+}
+
+// percentile returns the nearest-rank p-th percentile of values in O(n) on average. values is reordered.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(values)))) - 1
+	return selectKth(values, max(rank, 0))
+}
+
+// selectKth partially sorts values so that values[k] holds the k-th smallest element, which it
+// returns (quickselect)
+func selectKth(values []float64, k int) float64 {
+	lo, hi := 0, len(values)-1
+	for lo < hi {
+		pivot := values[(lo+hi)/2]
+		i, j := lo, hi
+		for i <= j {
+			for values[i] < pivot {
+				i++
+			}
+			for values[j] > pivot {
+				j--
+			}
+			if i <= j {
+				values[i], values[j] = values[j], values[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case k <= j:
+			hi = j
+		case k >= i:
+			lo = i
+		default:
+			return values[k]
+		}
+	}
+	return values[k]
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestResultsCSVMatchesResults checks that the batched CSV export lists the same results as
+// filteredResults, across several batches and a wrapped ring
+func TestResultsCSVMatchesResults(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.MaxResults = 3 * csvBatchSize
+	h := NewDownloadHandler(cfg)
+
+	start := time.Now().Add(-time.Hour)
+	for i := range 4 * csvBatchSize {
+		h.results.add(Result{
+			Timestamp:         start.Add(time.Duration(i) * time.Second),
+			ClientIP:          "192.0.2." + strconv.Itoa(i%3),
+			DownloadSpeedMbps: float64(i),
+			Status:            ResultVerified,
+		})
+	}
+
+	for _, query := range []string{"", "?ip=192.0.2.1", "?last=10", "?ip=192.0.2.2&last=300", "?last=100000"} {
+		req := httptest.NewRequest(http.MethodGet, "/results.csv"+query, nil)
+		f, err := parseResultFilter(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := h.filteredResults(f)
+
+		rec := httptest.NewRecorder()
+		h.GetResultsCSV(rec, req)
+		rows, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		rows = rows[1:] // Header
+		if len(rows) != len(want) {
+			t.Fatalf("%s: %d rows, want %d", query, len(rows), len(want))
+		}
+		for i, row := range rows {
+			if row[1] != want[i].ClientIP || row[3] != strconv.FormatFloat(want[i].DownloadSpeedMbps, 'f', 2, 64) {
+				t.Fatalf("%s: row %d = %v, want %+v", query, i, row, want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// NotFoundResponse is the body returned for paths no route matches
+type NotFoundResponse struct {
+	Error string    `json:"error"`
+	Code  ErrorCode `json:"code"`
+	Path  string    `json:"path"`
+}
+
+// NotFound answers requests for unknown paths with a JSON 404. Install it as router.NotFoundHandler.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(NotFoundResponse{Error: "not found", Code: CodeNotFound, Path: r.URL.Path})
+}
+
+// MethodNotAllowed answers requests whose path matches a route of router but whose method doesn't,
+// with a JSON error and an Allow header listing the methods the path does accept. Install it as
+// router.MethodNotAllowedHandler.
+func MethodNotAllowed(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, r), ", "))
+		writeJSONError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method "+r.Method+" not allowed")
+	})
+}
+
+// allowedMethods returns, sorted, every method that some route of router accepts for r's path
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	seen := make(map[string]bool)
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // The route matches any method, so it can't be why this one was refused
+		}
+		for _, method := range methods {
+			candidate := r.Clone(r.Context())
+			candidate.Method = method
+			if route.Match(candidate, &mux.RouteMatch{}) {
+				seen[method] = true
+			}
+		}
+		return nil
+	})
+
+	allowed := make([]string, 0, len(seen))
+	for method := range seen {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	return allowed
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// sharedFile is an immutable test file backing every session of one size. Content doesn't need to
+// differ per session to measure speed, so sharing it saves both disk and generation time. The file
+// is deleted once the last session using it is released.
+type sharedFile struct {
+	size  int64
+	path  string
+	hash  string
+	refs  int
+	ready chan struct{} // Closed once generation has finished, successfully or not
+	err   error
+}
+
+// acquireSharedFile returns the shared file for size, generating it if no session currently holds
+// one. Concurrent callers for the same size wait for a single generation.
+func (h *DownloadHandler) acquireSharedFile(ctx context.Context, size int64) (*sharedFile, error) {
+	for {
+		h.mu.Lock()
+		sf, exists := h.sharedFiles[size]
+		if !exists {
+			break // Still holding h.mu; this caller generates the file
+		}
+		sf.refs++
+		h.mu.Unlock()
+
+		select {
+		case <-sf.ready:
+		case <-ctx.Done():
+			h.mu.Lock()
+			h.releaseSharedFile(sf)
+			h.mu.Unlock()
+			return nil, ctx.Err()
+		}
+
+		if sf.err == nil {
+			return sf, nil
+		}
+		h.mu.Lock()
+		h.releaseSharedFile(sf)
+		h.mu.Unlock()
+
+		// The generating request gave up; retry so this one generates instead
+		if !errors.Is(sf.err, context.Canceled) {
+			return nil, sf.err
+		}
+	}
+
+	path, err := h.dataPath(h.pickDataDir(), fmt.Sprintf("shared-%d-%s.bin", size, uuid.New().String()))
+	if err != nil {
+		h.mu.Unlock()
+		return nil, err
+	}
+	sf := &sharedFile{size: size, path: path, refs: 1, ready: make(chan struct{})}
+	h.sharedFiles[size] = sf
+	h.mu.Unlock()
+
+	sf.hash, sf.err = h.prepareFile(ctx, path, size, nil, GenerationRandom)
+	if sf.err != nil {
+		// Unmap it before waking the waiters, so no new caller joins a file that failed while the
+		// waiters still hold references to it
+		h.mu.Lock()
+		if h.sharedFiles[size] == sf {
+			delete(h.sharedFiles, size)
+		}
+		h.releaseSharedFile(sf)
+		h.mu.Unlock()
+	}
+	close(sf.ready)
+
+	return sf, sf.err
+}
+
+// releaseSharedFile drops one reference, deleting the file when it was the last. The caller must hold h.mu.
+func (h *DownloadHandler) releaseSharedFile(sf *sharedFile) error {
+	sf.refs--
+	if sf.refs > 0 {
+		return nil
+	}
+	if h.sharedFiles[sf.size] == sf {
+		delete(h.sharedFiles, sf.size)
+	}
+	if err := os.Remove(sf.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
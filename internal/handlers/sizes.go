@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type SizesResponse struct {
+	SizesMB        []int    `json:"sizes_mb"`
+	SparseSizesMB  []int    `json:"sparse_sizes_mb,omitempty"` // Also allowed with generation zero
+	HashAlgorithms []string `json:"hash_algorithms"`
+	MaxConnections int      `json:"max_connections"`
+}
+
+// sortedSizesMB returns the allowed download sizes in MB, smallest first
+func sortedSizesMB() []int {
+	sizes := make([]int, 0, len(allowedSizes))
+	for sizeMB := range allowedSizes {
+		sizes = append(sizes, sizeMB)
+	}
+	slices.Sort(sizes)
+	return sizes
+}
+
+// invalidSizeMessage lists the allowed sizes for clients that requested something else
+func invalidSizeMessage() string {
+	sizes := sortedSizesMB()
+	parts := make([]string, len(sizes))
+	for i, sizeMB := range sizes {
+		parts[i] = strconv.Itoa(sizeMB)
+	}
+	return "Invalid size requested. Allowed values: " + strings.Join(parts, ",")
+}
+
+// jitterSize pads size by a random, even number of bytes up to SizeJitterBytes, so each session's
+// file differs in length and a cache keyed on the response can't serve one session's download for
+// another. Compressible content comes in pairs of hex digits, hence even. Seeded sessions keep the
+// size they asked for, since the same seed must keep giving the same bytes.
+func (h *DownloadHandler) jitterSize(size int64, seed *int64) int64 {
+	if h.cfg.SizeJitterBytes <= 0 || seed != nil {
+		return size
+	}
+	return size + 2*rand.Int63n(int64(h.cfg.SizeJitterBytes)/2+1)
+}
+
+// GetSizes lets clients discover what the server permits instead of hardcoding it
+func (h *DownloadHandler) GetSizes(w http.ResponseWriter, r *http.Request) {
+	algorithms := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		algorithms = append(algorithms, name)
+	}
+	slices.Sort(algorithms)
+
+	resp := SizesResponse{
+		SizesMB:        sortedSizesMB(),
+		HashAlgorithms: algorithms,
+		MaxConnections: h.cfg.MaxConnections,
+	}
+	if h.sparseZeroFiles() {
+		for sizeMB := range sparseSizes {
+			resp.SparseSizesMB = append(resp.SparseSizesMB, sizeMB)
+		}
+		slices.Sort(resp.SparseSizesMB)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
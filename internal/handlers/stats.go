@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type StatsResponse struct {
+	TotalBytesSent  int64            `json:"total_bytes_sent"`
+	BytesSentByIP   map[string]int64 `json:"bytes_sent_by_ip"`
+	Downloads       map[string]int64 `json:"downloads"` // Finished downloads by outcome: complete, incomplete or cancelled
+	SessionsCreated int64            `json:"sessions_created"`
+	ResultsRetained int              `json:"results_retained"`    // Results currently kept for /results and /summary
+	Bandwidth       *BandwidthStats  `json:"bandwidth,omitempty"` // Set when -max-total-mbps caps downloads
+}
+
+type BandwidthStats struct {
+	LimitMbps   float64 `json:"limit_mbps"`
+	CurrentMbps float64 `json:"current_mbps"` // Measured over the last second
+	Utilization float64 `json:"utilization"`  // current_mbps over limit_mbps
+}
+
+// downloadOutcomeStatuses are the outcomes a finished download is counted under
+var downloadOutcomeStatuses = []string{DownloadComplete, DownloadIncomplete, DownloadCancelled}
+
+// newOutcomeCounters returns a counter per download outcome. The map itself is never written again,
+// so it can be read concurrently without a lock.
+func newOutcomeCounters() map[string]*atomic.Int64 {
+	counters := make(map[string]*atomic.Int64, len(downloadOutcomeStatuses))
+	for _, status := range downloadOutcomeStatuses {
+		counters[status] = new(atomic.Int64)
+	}
+	return counters
+}
+
+// ipBytesSent is a client's entry in bytesSentByIP
+type ipBytesSent struct {
+	bytes    atomic.Int64
+	lastSent atomic.Int64 // statsClock as of the client's last download, for evictBytesSentByIP
+}
+
+// recordBytesSent adds bytes actually written to a client to the global and per-IP totals. Only a
+// client's first download allocates; later ones just add to its counter. The time of the download
+// comes from statsClock, as time.Now would cost more than the rest put together.
+func (h *DownloadHandler) recordBytesSent(clientIP string, n int64) {
+	h.totalBytesSent.Add(n)
+
+	entry, ok := h.bytesSentByIP.Load(clientIP)
+	if !ok {
+		entry, _ = h.bytesSentByIP.LoadOrStore(clientIP, new(ipBytesSent))
+	}
+	e := entry.(*ipBytesSent)
+	e.bytes.Add(n)
+	if now := h.statsClock.Load(); e.lastSent.Load() != now {
+		e.lastSent.Store(now)
+	}
+}
+
+// evictBytesSentByIP drops the per-IP totals of clients that haven't been sent anything for a
+// session TTL, so the map doesn't grow with every address ever seen. The global total keeps their
+// bytes. A download finishing just as its client is dropped may lose its bytes from the per-IP
+// figure only.
+func (h *DownloadHandler) evictBytesSentByIP(now time.Time) {
+	cutoff := now.Add(-h.cfg.SessionTTL).Unix()
+	h.bytesSentByIP.Range(func(ip, entry any) bool {
+		if entry.(*ipBytesSent).lastSent.Load() < cutoff {
+			h.bytesSentByIP.CompareAndDelete(ip, entry)
+		}
+		return true
+	})
+}
+
+// recordDownloadOutcome counts a finished download under its DownloadStatus
+func (h *DownloadHandler) recordDownloadOutcome(status string) {
+	h.downloadOutcomes[status].Add(1)
+}
+
+// GetStats reports how much data the server has served, overall and per client IP, and how the
+// downloads ended
+func (h *DownloadHandler) GetStats(w http.ResponseWriter, r *http.Request) {
+	// Each counter is read atomically, but downloads finishing meanwhile may be counted in some
+	// figures and not yet in others
+	resp := StatsResponse{
+		TotalBytesSent:  h.totalBytesSent.Load(),
+		BytesSentByIP:   make(map[string]int64),
+		Downloads:       make(map[string]int64, len(downloadOutcomeStatuses)),
+		SessionsCreated: h.sessionsCreated.Load(),
+	}
+	h.bytesSentByIP.Range(func(ip, entry any) bool {
+		resp.BytesSentByIP[ip.(string)] = entry.(*ipBytesSent).bytes.Load()
+		return true
+	})
+	for _, status := range downloadOutcomeStatuses {
+		resp.Downloads[status] = h.downloadOutcomes[status].Load()
+	}
+	h.mu.Lock()
+	resp.ResultsRetained = h.results.count
+	h.mu.Unlock()
+
+	if h.bandwidth != nil {
+		current, utilization := h.bandwidth.utilization(time.Now())
+		resp.Bandwidth = &BandwidthStats{
+			LimitMbps:   h.cfg.MaxTotalMbps,
+			CurrentMbps: current,
+			Utilization: utilization,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
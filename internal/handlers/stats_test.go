@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvictBytesSentByIP(t *testing.T) {
+	h := newTestHandler(t)
+	h.recordBytesSent("192.0.2.1", 100)
+	h.recordBytesSent("192.0.2.2", 200)
+	stale, _ := h.bytesSentByIP.Load("192.0.2.1")
+	stale.(*ipBytesSent).lastSent.Store(time.Now().Add(-2 * h.cfg.SessionTTL).Unix())
+
+	h.evictBytesSentByIP(time.Now())
+
+	if _, ok := h.bytesSentByIP.Load("192.0.2.1"); ok {
+		t.Error("idle client was not evicted")
+	}
+	if _, ok := h.bytesSentByIP.Load("192.0.2.2"); !ok {
+		t.Error("active client was evicted")
+	}
+	if got := h.totalBytesSent.Load(); got != 300 {
+		t.Errorf("total = %d, want 300", got)
+	}
+}
+
+// mutexBytesSent is the h.mu-guarded accounting recordBytesSent replaced, kept as a baseline
+type mutexBytesSent struct {
+	mu    sync.Mutex
+	total int64
+	byIP  map[string]int64
+}
+
+func (m *mutexBytesSent) record(clientIP string, n int64) {
+	m.mu.Lock()
+	m.total += n
+	m.byIP[clientIP] += n
+	m.mu.Unlock()
+}
+
+// BenchmarkRecordBytesSent records downloads from 256 client IPs in parallel; run it with -cpu to
+// see how each approach scales
+func BenchmarkRecordBytesSent(b *testing.B) {
+	ips := make([]string, 256)
+	for i := range ips {
+		ips[i] = "10.0.0." + strconv.Itoa(i)
+	}
+
+	b.Run("atomic", func(b *testing.B) {
+		h := newTestHandler(b)
+		var next atomic.Uint32
+		b.RunParallel(func(pb *testing.PB) {
+			i := int(next.Add(1))
+			for pb.Next() {
+				h.recordBytesSent(ips[i%len(ips)], 1024)
+				i++
+			}
+		})
+	})
+	b.Run("mutex", func(b *testing.B) {
+		m := &mutexBytesSent{byIP: make(map[string]int64)}
+		var next atomic.Uint32
+		b.RunParallel(func(pb *testing.PB) {
+			i := int(next.Add(1))
+			for pb.Next() {
+				m.record(ips[i%len(ips)], 1024)
+				i++
+			}
+		})
+	})
+}
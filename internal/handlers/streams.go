@@ -0,0 +1,44 @@
+package handlers
+
+// StreamResult is one complete download among the parallel downloads of a session
+type StreamResult struct {
+	Bytes     int64
+	SpeedMbps float64
+}
+
+// StreamStats compares the parallel downloads of a session. A gap between the aggregate and the
+// fastest single stream points at a per-connection limit, such as a single-flow cap on the path.
+type StreamStats struct {
+	Count         int     `json:"count"`
+	AggregateMbps float64 `json:"aggregate_mbps"`  // Sum of the streams' speeds
+	MaxStreamMbps float64 `json:"max_stream_mbps"` // Speed of the fastest stream
+	Bytes         []int64 `json:"bytes"`           // Per stream, in the order they finished
+}
+
+// startStreams begins a new round of parallel downloads on sess when none is running, so the
+// streams compared are those of the latest test. The caller must hold h.mu.
+func startStreams(sess *Session) {
+	if sess.activeDownloads == 0 {
+		sess.Streams = nil
+	}
+}
+
+// recordStream adds a complete download to the current round of sess. The caller must hold h.mu.
+func recordStream(sess *Session, bytes int64, speedMbps float64) {
+	sess.Streams = append(sess.Streams, StreamResult{Bytes: bytes, SpeedMbps: speedMbps})
+}
+
+// streamStats summarises the current round of sess, or returns nil if no download in it has
+// completed. The caller must hold h.mu.
+func streamStats(sess *Session) *StreamStats {
+	if len(sess.Streams) == 0 {
+		return nil
+	}
+	stats := &StreamStats{Count: len(sess.Streams), Bytes: make([]int64, len(sess.Streams))}
+	for i, s := range sess.Streams {
+		stats.AggregateMbps += s.SpeedMbps
+		stats.MaxStreamMbps = max(stats.MaxStreamMbps, s.SpeedMbps)
+		stats.Bytes[i] = s.Bytes
+	}
+	return stats
+}
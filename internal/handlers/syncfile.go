@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// directIOAlignment is the block size O_DIRECT writes are aligned to, in memory and on disk. 4 KB
+// satisfies every common logical block size.
+const directIOAlignment = 4096
+
+// generatedFile is a test file being written, honouring the FsyncFiles and DirectIO settings. Write
+// to it, then call finish so the last bytes reach the file and, if configured, the disk. Only Write
+// is offered, so io.Copy can't go around the aligning buffer via the file's ReadFrom.
+type generatedFile struct {
+	f     *os.File
+	w     io.Writer // f, or an aligning buffer in front of it for direct I/O
+	fsync bool
+}
+
+// createGeneratedFile creates or truncates path for generation. With DirectIO the data bypasses the
+// page cache, which needs aligned writes, so it goes through a directWriter.
+func (h *DownloadHandler) createGeneratedFile(path string) (*generatedFile, error) {
+	if !h.cfg.DirectIO {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		return &generatedFile{f: f, w: f, fsync: h.cfg.FsyncFiles}, nil
+	}
+	f, err := createDirect(path)
+	if err != nil {
+		return nil, err
+	}
+	dw := &directWriter{f: f, buf: alignedBuffer(h.cfg.GenerateBufferKB * 1024)}
+	return &generatedFile{f: f, w: dw, fsync: h.cfg.FsyncFiles}, nil
+}
+
+func (g *generatedFile) Write(p []byte) (int, error) {
+	return g.w.Write(p)
+}
+
+// finish writes out anything still buffered and, with FsyncFiles, waits for the disk to have it all.
+// The file stays open.
+func (g *generatedFile) finish() error {
+	if dw, ok := g.w.(*directWriter); ok {
+		if err := dw.flush(); err != nil {
+			return err
+		}
+	}
+	if g.fsync {
+		return g.f.Sync()
+	}
+	return nil
+}
+
+func (g *generatedFile) Close() error {
+	return g.f.Close()
+}
+
+// directWriter collects writes into whole aligned blocks for a file opened with O_DIRECT
+type directWriter struct {
+	f   *os.File
+	buf []byte // Aligned in memory, and a multiple of directIOAlignment long
+	n   int
+}
+
+func (dw *directWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		copied := copy(dw.buf[dw.n:], p)
+		dw.n += copied
+		written += copied
+		p = p[copied:]
+		if dw.n == len(dw.buf) {
+			if _, err := dw.f.Write(dw.buf); err != nil {
+				return written, err
+			}
+			dw.n = 0
+		}
+	}
+	return written, nil
+}
+
+// flush writes the final partial buffer. Its length is rarely a whole number of blocks, so direct
+// I/O is turned off for it.
+func (dw *directWriter) flush() error {
+	if dw.n == 0 {
+		return nil
+	}
+	if err := disableDirect(dw.f); err != nil {
+		return err
+	}
+	_, err := dw.f.Write(dw.buf[:dw.n])
+	dw.n = 0
+	return err
+}
+
+// alignedBuffer returns a buffer of at least size bytes, rounded up to whole blocks, whose start is
+// aligned to directIOAlignment as O_DIRECT requires
+func alignedBuffer(size int) []byte {
+	size = (size + directIOAlignment - 1) / directIOAlignment * directIOAlignment
+	buf := make([]byte, size+directIOAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % directIOAlignment); rem != 0 {
+		offset = directIOAlignment - rem
+	}
+	return buf[offset : offset+size]
+}
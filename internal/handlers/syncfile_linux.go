@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// directIOSupported reports whether Config.DirectIO can be used on this platform
+const directIOSupported = true
+
+// createDirect creates or truncates path for writing with O_DIRECT
+func createDirect(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|unix.O_DIRECT, 0o644)
+}
+
+// disableDirect clears O_DIRECT on f, so unaligned writes work again
+func disableDirect(f *os.File) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = conn.Control(func(fd uintptr) {
+		var flags int
+		if flags, opErr = unix.FcntlInt(fd, unix.F_GETFL, 0); opErr == nil {
+			_, opErr = unix.FcntlInt(fd, unix.F_SETFL, flags&^unix.O_DIRECT)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
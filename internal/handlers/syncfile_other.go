@@ -0,0 +1,23 @@
+//go:build !linux
+
+package handlers
+
+import (
+	"errors"
+	"os"
+)
+
+// directIOSupported reports whether Config.DirectIO can be used on this platform
+const directIOSupported = false
+
+var errNoDirectIO = errors.New("direct I/O is only available on Linux")
+
+// createDirect is only implemented on Linux
+func createDirect(path string) (*os.File, error) {
+	return nil, errNoDirectIO
+}
+
+// disableDirect is only implemented on Linux
+func disableDirect(f *os.File) error {
+	return errNoDirectIO
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import "fmt"
+
+// Limits on client-supplied session tags, so they can't be used to bloat server memory
+const (
+	maxTags           = 16
+	maxTagKeyLength   = 64
+	maxTagValueLength = 256
+)
+
+// validateTags checks the number and size of the tags supplied with an init request
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	for key, value := range tags {
+		if key == "" || len(key) > maxTagKeyLength {
+			return fmt.Errorf("tag keys must be 1-%d bytes", maxTagKeyLength)
+		}
+		if len(value) > maxTagValueLength {
+			return fmt.Errorf("value of tag %q exceeds %d bytes", key, maxTagValueLength)
+		}
+	}
+	return nil
+}
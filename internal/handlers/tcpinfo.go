@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// TCPInfo is the kernel's view of a download's TCP connection, read right after the response was
+// written. It helps tell a lossy or high-latency path from a slow one. On HTTP/2 the connection may
+// have carried other requests too.
+type TCPInfo struct {
+	RTTMs            float64 `json:"rtt_ms"`            // Smoothed round-trip time
+	RTTVarMs         float64 `json:"rtt_var_ms"`        // Round-trip time variance
+	TotalRetransmits uint32  `json:"total_retransmits"` // Segments retransmitted over the connection's life
+	SndCwnd          uint32  `json:"snd_cwnd"`          // Congestion window, in segments
+	SndMSS           uint32  `json:"snd_mss"`           // Maximum segment size for sending, in bytes
+	PathMTU          uint32  `json:"path_mtu"`          // Path MTU as last discovered, in bytes
+}
+
+// ConnContext stores each connection in the contexts of its requests, so handlers can inspect the
+// socket. Install it as http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey, c)
+}
+
+// requestTCPInfo reads the TCP info of the connection r arrived on. It is nil when ConnContext
+// isn't installed, the connection isn't TCP, or the platform can't report it.
+func requestTCPInfo(r *http.Request) *TCPInfo {
+	conn, ok := r.Context().Value(connKey).(net.Conn)
+	if !ok {
+		return nil
+	}
+	return readTCPInfo(conn)
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTCPInfo asks the kernel for the TCP_INFO of conn, looking through TLS to the socket below
+func readTCPInfo(conn net.Conn) *TCPInfo {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || sockErr != nil {
+		return nil // e.g. a Unix socket
+	}
+	return &TCPInfo{
+		RTTMs:            float64(info.Rtt) / 1000,
+		RTTVarMs:         float64(info.Rttvar) / 1000,
+		TotalRetransmits: info.Total_retrans,
+		SndCwnd:          info.Snd_cwnd,
+		SndMSS:           info.Snd_mss,
+		PathMTU:          info.Pmtu,
+	}
+}
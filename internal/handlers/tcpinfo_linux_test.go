@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestDownloadRecordsTCPInfo downloads a sized and a timed session over a real TCP connection and
+// checks both report the connection's TCP info
+func TestDownloadRecordsTCPInfo(t *testing.T) {
+	h := newTestHandler(t)
+	h.cfg.RateLimitPerMB = 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(h.DownloadData))
+	srv.Config.ConnContext = ConnContext
+	srv.Start()
+	defer srv.Close()
+
+	for _, body := range []string{`{"size_mb":5}`, `{"duration_sec":1}`} {
+		req := httptest.NewRequest(http.MethodPost, "/download/init", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.InitDownload(rec, req)
+		var sess DownloadInitResponse
+		if err := json.NewDecoder(rec.Body).Decode(&sess); err != nil || sess.SessionID == "" {
+			t.Fatalf("init %s: status %d: %v", body, rec.Code, err)
+		}
+
+		resp, err := http.Get(srv.URL + "/download/data?session_id=" + sess.SessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		speed := httptest.NewRecorder()
+		h.GetSpeed(speed, httptest.NewRequest(http.MethodGet, "/download/speed?session_id="+sess.SessionID, nil))
+		var got SpeedResponse
+		if err := json.NewDecoder(speed.Body).Decode(&got); err != nil {
+			t.Fatalf("speed %s: status %d: %v", body, speed.Code, err)
+		}
+		if got.Status != DownloadComplete {
+			t.Fatalf("%s: download %s, want complete", body, got.Status)
+		}
+		if got.TCPInfo == nil || got.TCPInfo.SndMSS == 0 {
+			t.Errorf("%s: tcp_info = %+v, want the connection's figures", body, got.TCPInfo)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package handlers
+
+import "net"
+
+// readTCPInfo is only implemented on Linux
+func readTCPInfo(conn net.Conn) *TCPInfo {
+	return nil
+}
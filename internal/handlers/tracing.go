@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer reports to the global OpenTelemetry provider, which drops every span unless the server
+// installed an exporter at startup
+var tracer = otel.Tracer("speedtest/internal/handlers")
+
+// Trace starts a server span for each request, continuing the trace of a traceparent header when
+// the client sent one. The span is named after the route, so session IDs in paths don't multiply
+// span names, and records the status code. Handlers add their phases as child spans.
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				name = tmpl
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", name),
+				attribute.String("client.address", getClientIP(r)),
+				attribute.String("speedtest.request_id", requestIDFrom(r.Context())),
+			),
+		)
+		defer span.End()
+		if sessionID := r.URL.Query().Get("session_id"); sessionID != "" {
+			span.SetAttributes(attribute.String("speedtest.session_id", sessionID))
+		}
+
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", sr.status),
+			attribute.Int64("speedtest.response_bytes", sr.bytes),
+		)
+		if sr.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sr.status))
+		}
+	})
+}
+
+// startSpan starts a child span of the request's span for one phase of handling it, such as
+// generating or hashing a file
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceTransfer records the outcome of a transfer on the request's span
+func traceTransfer(ctx context.Context, bytes int64, speedMbps float64) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int64("speedtest.transfer_bytes", bytes),
+		attribute.Float64("speedtest.speed_mbps", speedMbps),
+	)
+}
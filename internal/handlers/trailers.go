@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Trailers that carry a download's result at the end of /download/data, sparing a /download/speed call
+const (
+	TrailerSpeedMbps        = "X-Download-Speed-Mbps"
+	TrailerBytesTransferred = "X-Bytes-Transferred"
+	// TrailerSHA256 carries the SHA-256 of the payload as it was streamed, when hash_trailer=true
+	TrailerSHA256 = "X-Content-Sha256"
+)
+
+// wantsTrailers reports whether the result trailers should be sent. HTTP/2 always carries trailers;
+// HTTP/1.1 clients have to announce they read them with "TE: trailers".
+func wantsTrailers(r *http.Request) bool {
+	if r.ProtoMajor >= 2 {
+		return true
+	}
+	for _, te := range strings.Split(r.Header.Get("TE"), ",") {
+		name, _, _ := strings.Cut(te, ";")
+		if strings.EqualFold(strings.TrimSpace(name), "trailers") {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsHashTrailer reports whether the client asked for the streamed hash in a trailer. Such a client
+// reads trailers by definition, so this also turns the result trailers on.
+func wantsHashTrailer(r *http.Request) bool {
+	return r.URL.Query().Get("hash_trailer") == "true"
+}
+
+// declareResultTrailers announces the result trailers. It must be called before the body is written.
+func declareResultTrailers(header http.Header) {
+	header.Set("Trailer", TrailerSpeedMbps+", "+TrailerBytesTransferred)
+}
+
+// setResultTrailers fills in the trailers announced by declareResultTrailers once the body is done
+func setResultTrailers(header http.Header, speedMbps float64, bytesTransferred int64) {
+	header.Set(TrailerSpeedMbps, strconv.FormatFloat(speedMbps, 'f', 2, 64))
+	header.Set(TrailerBytesTransferred, strconv.FormatInt(bytesTransferred, 10))
+}
+
+// declareHashTrailer announces the hash trailer next to the result trailers
+func declareHashTrailer(header http.Header) {
+	header.Add("Trailer", TrailerSHA256)
+}
+
+// hashingReader hashes the bytes read from a file since its last seek, which are the bytes a response
+// served from it: ServeContent seeks back after sniffing the content type and seeks to the start of
+// a range before copying it.
+type hashingReader struct {
+	src    io.ReadSeeker
+	hasher hash.Hash
+}
+
+func newHashingReader(src io.ReadSeeker) *hashingReader {
+	return &hashingReader{src: src, hasher: sha256.New()}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.src.Read(p)
+	hr.hasher.Write(p[:n])
+	return n, err
+}
+
+func (hr *hashingReader) Seek(offset int64, whence int) (int64, error) {
+	hr.hasher.Reset()
+	return hr.src.Seek(offset, whence)
+}
+
+// sum returns the hex SHA-256 of the bytes read since the last seek
+func (hr *hashingReader) sum() string {
+	return hex.EncodeToString(hr.hasher.Sum(nil))
+}
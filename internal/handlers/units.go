@@ -0,0 +1,26 @@
+package handlers
+
+import "strings"
+
+// speedUnit converts a speed in Mbps into another unit. Speeds use binary prefixes throughout
+// (1 Mbps = 1024*1024 bits per second), so the conversions stay exact.
+type speedUnit struct {
+	name     string
+	fromMbps float64
+}
+
+// Units accepted by the units query parameter, keyed by their lower-cased spelling
+var speedUnits = map[string]speedUnit{
+	"mbps": {name: "Mbps", fromMbps: 1},
+	"mb/s": {name: "MB/s", fromMbps: 1.0 / 8},
+	"gbps": {name: "Gbps", fromMbps: 1.0 / 1024},
+}
+
+// parseSpeedUnit looks up a units parameter case-insensitively, defaulting to Mbps when it is empty
+func parseSpeedUnit(value string) (speedUnit, bool) {
+	if value == "" {
+		return speedUnits["mbps"], true
+	}
+	unit, ok := speedUnits[strings.ToLower(value)]
+	return unit, ok
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+type UploadResponse struct {
+	SessionID       string  `json:"session_id"`
+	BytesReceived   int64   `json:"bytes_received"`
+	UploadSpeedMbps float64 `json:"upload_speed_mbps"`
+	// Parts lists the parts of a multipart/form-data upload, up to maxUploadParts of them
+	Parts []UploadPart `json:"parts,omitempty"`
+}
+
+// UploadData reads and discards the request body, measuring how fast the client can push data to the server.
+// A multipart/form-data body, as sent by browser-based testers, is read part by part and each part is hashed.
+func (h *DownloadHandler) UploadData(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		writeJSONError(w, http.StatusBadRequest, CodeSessionIDRequired, "session_id is required")
+		return
+	}
+
+	h.mu.Lock()
+	sess, status := h.findSession(sessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
+		return
+	}
+	if msg := enterPhase(sess, PhaseUpload); msg != "" {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, CodePhaseOutOfOrder, msg)
+		return
+	}
+	h.mu.Unlock()
+
+	limit := int64(h.cfg.MaxUploadMB) * 1024 * 1024
+	if r.ContentLength > limit {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, CodeUploadTooLarge, fmt.Sprintf("Upload exceeds the %d MB limit", h.cfg.MaxUploadMB))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	var body io.Reader = r.Body
+	var dt *duplexTest
+	if wantsDuplex(r) {
+		var ok bool
+		if dt, ok = h.joinDuplex(w, r, sess, duplexUpload); !ok {
+			return
+		}
+		body = &progressReader{Reader: r.Body, n: &dt.up}
+	}
+
+	// Start tracking time
+	startTime := time.Now()
+
+	var received int64
+	var parts []UploadPart
+	var err error
+	boundary := multipartBoundary(r)
+	if boundary != "" {
+		received, parts, err = discardMultipart(body, boundary)
+	} else {
+		received, err = io.Copy(io.Discard, body)
+	}
+	if dt != nil {
+		h.finishDuplex(sess, dt, err == nil)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.Printf("Upload for session %s exceeded %d bytes", sessionID, limit)
+		writeJSONError(w, http.StatusRequestEntityTooLarge, CodeUploadTooLarge, fmt.Sprintf("Upload exceeds the %d MB limit", h.cfg.MaxUploadMB))
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading upload for session %s: %v", sessionID, err)
+		msg := "Upload failed"
+		if boundary != "" {
+			msg = "Upload failed: malformed or truncated multipart body"
+		}
+		writeJSONError(w, http.StatusBadRequest, CodeUploadFailed, msg)
+		return
+	}
+
+	speedMbps := computeSpeedMbps(received, time.Since(startTime))
+	traceTransfer(r.Context(), received, speedMbps)
+
+	h.mu.Lock()
+	sess.UploadBytes = received
+	sess.UploadSpeedMbps = speedMbps
+	if sess.FullTestPhase == PhaseUpload {
+		sess.FullTestPhase = PhaseDone
+	}
+	h.mu.Unlock()
+
+	log.Printf("Upload speed for session %s: %.2f Mbps", sessionID, speedMbps)
+
+	resp := UploadResponse{
+		SessionID:       sessionID,
+		BytesReceived:   received,
+		UploadSpeedMbps: speedMbps,
+		Parts:           parts,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// verifyHashes checks every hash in req.ComputedHashes against the session file, hashed afresh
+// with each algorithm, and reports pass/fail per algorithm. Using several algorithms catches
+// corruption that a single weak checksum could miss. With req.VerifyBytes only that many leading
+// bytes are hashed, so low-power clients can catch gross corruption cheaply; a lone computed_hash is
+// then taken as the session's sha256. The file is only removed when all of them pass over the whole
+// file (and then not if req.Keep is set). A passing partial check is recorded as verified_partial
+// and leaves the session open, since most of the file was never checked.
+func (h *DownloadHandler) verifyHashes(w http.ResponseWriter, r *http.Request, req DownloadVerifyRequest) {
+	if req.VerifyBytes < 0 {
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidParameter, "verify_bytes must not be negative")
+		return
+	}
+	hashes := req.ComputedHashes
+	if len(hashes) == 0 {
+		hashes = map[string]string{"sha256": req.ComputedHash}
+	}
+
+	computed := make(map[string]string, len(hashes))
+	for algorithm, value := range hashes {
+		value = strings.ToLower(value)
+		if err := validateHashFormat(algorithm, value); err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, CodeMalformedHash, "Malformed computed_hashes["+algorithm+"]: "+err.Error())
+			return
+		}
+		computed[algorithm] = value
+	}
+
+	h.mu.Lock()
+	sess, status := h.findSession(req.SessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
+		return
+	}
+	if msg := receivedBytesMismatch(sess, req.ReceivedBytes); msg != "" {
+		h.recordResult(req.SessionID, sess, ResultSizeMismatch)
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusBadRequest, CodeSizeMismatch, msg)
+		return
+	}
+	if sess.Duration > 0 || sess.Diskless {
+		h.mu.Unlock()
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "computed_hashes and verify_bytes are not supported for timed and diskless sessions")
+		return
+	}
+	filePath := sess.FilePath
+	h.mu.Unlock()
+
+	// Hashing a large file takes a while, so it is done without holding the lock
+	release, ok := h.acquireHashSlot(w, r)
+	if !ok {
+		return
+	}
+	_, span := startSpan(r.Context(), "hash")
+	actual, hashed, hashErr := computeFileHashes(filePath, computed, req.VerifyBytes, h.cfg.HashBufferKB*1024)
+	span.SetAttributes(attribute.Int64("speedtest.bytes_hashed", hashed))
+	endSpan(span, hashErr)
+	release()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The session may have been verified or expired meanwhile, taking its file with it
+	if current, status := h.findSession(req.SessionID); current != sess {
+		writeSessionError(w, status)
+		return
+	}
+	if hashErr != nil {
+		log.Printf("Error hashing %s: %v", filePath, hashErr)
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Internal Server Error")
+		return
+	}
+
+	resp := DownloadVerifyResponse{Status: "success", Results: make(map[string]bool, len(computed)), BytesHashed: hashed}
+	for algorithm, value := range computed {
+		resp.Results[algorithm] = hashesEqual(value, actual[algorithm])
+		if !resp.Results[algorithm] {
+			resp.Status = "mismatch"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "success" {
+		h.recordResult(req.SessionID, sess, ResultHashMismatch)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if hashed < sess.FileSize {
+		h.recordResult(req.SessionID, sess, ResultVerifiedPartial)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if err := h.completeVerification(req.SessionID, sess, req.Keep); err != nil {
+		log.Printf("Error removing file: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "File removal failed")
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// computeFileHashes hashes the file at path in a single pass with each algorithm named in the keys
+// of algorithms, returning hex digests keyed the same way and the number of bytes hashed. A positive
+// limit hashes only that many leading bytes. The file is read bufSize bytes at a time.
+func computeFileHashes(path string, algorithms map[string]string, limit int64, bufSize int) (map[string]string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	hashers := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for algorithm := range algorithms {
+		hashers[algorithm] = hashAlgorithms[algorithm]()
+		writers = append(writers, hashers[algorithm])
+	}
+	var src io.Reader = readerOnly{f}
+	if limit > 0 {
+		src = io.LimitReader(f, limit)
+	}
+	n, err := io.CopyBuffer(io.MultiWriter(writers...), src, make([]byte, bufSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	digests := make(map[string]string, len(hashers))
+	for algorithm, hasher := range hashers {
+		digests[algorithm] = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return digests, n, nil
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPartialVerifyKeepsSession(t *testing.T) {
+	h := newTestHandler(t)
+	sess := initTestSession(t, h, 5)
+
+	h.mu.Lock()
+	filePath := h.sessions[sess.SessionID].FilePath
+	h.mu.Unlock()
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data[:1024])
+
+	body := `{"session_id":"` + sess.SessionID + `","computed_hash":"` + hex.EncodeToString(sum[:]) + `","verify_bytes":1024}`
+	req := httptest.NewRequest(http.MethodPost, "/download/verify", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.VerifyDownload(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("file removed after a partial check: %v", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.sessions[sess.SessionID]; !ok {
+		t.Error("session removed after a partial check")
+	}
+	var statuses []string
+	h.results.each(func(res Result) { statuses = append(statuses, res.Status) })
+	if len(statuses) != 1 || statuses[0] != ResultVerifiedPartial {
+		t.Errorf("recorded %v, want [%s]", statuses, ResultVerifiedPartial)
+	}
+}
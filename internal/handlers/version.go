@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Build information, injected at build time with
+//
+//	go build -ldflags "-X speedtest/internal/handlers.Version=v1.2.0 -X speedtest/internal/handlers.Commit=$(git rev-parse --short HEAD) -X speedtest/internal/handlers.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// GetVersion reports which build of the server is running
+func GetVersion(w http.ResponseWriter, r *http.Request) {
+	resp := VersionResponse{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	// warmupTargetSeconds is how long a well-sized test should take. Shorter transfers are dominated
+	// by connection ramp-up; longer ones waste time on slow links.
+	warmupTargetSeconds = 8
+	// warmupMaxGrowth bounds how much bigger each recommendation can be than the size just measured,
+	// since a small transfer's speed is too noisy to jump straight to the largest file on
+	warmupMaxGrowth = 10
+	// bytesPerConnection is roughly how much each parallel connection should carry to spend most of
+	// the transfer past TCP slow start. Splitting a file more finely measures ramp-up, not the link.
+	bytesPerConnection = 25 * 1024 * 1024
+)
+
+type NextSizeResponse struct {
+	SessionID         string  `json:"session_id"`
+	SizeMB            int     `json:"size_mb"`
+	DownloadSpeedMbps float64 `json:"download_speed_mbps"`
+	NextSizeMB        int     `json:"next_size_mb"`
+	Converged         bool    `json:"converged"` // next_size_mb is this session's size; no further warmup needed
+}
+
+// GetNextSize recommends the size to request next, from the speed a finished download achieved.
+// Clients start small and follow the recommendation until it converges, which takes a couple of
+// round trips whatever the link speed.
+func (h *DownloadHandler) GetNextSize(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		writeJSONError(w, http.StatusBadRequest, CodeSessionIDRequired, "session_id is required")
+		return
+	}
+
+	h.mu.Lock()
+	sess, status := h.findSession(sessionID)
+	if sess == nil {
+		h.mu.Unlock()
+		writeSessionError(w, status)
+		return
+	}
+	duration, fileSize := sess.Duration, sess.FileSize
+	speedMbps, downloadStatus := sess.DownloadSpeedMbps, sess.DownloadStatus
+	h.mu.Unlock()
+
+	if duration > 0 {
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupported, "Timed sessions adapt to the link already")
+		return
+	}
+	if downloadStatus != DownloadComplete {
+		writeJSONError(w, http.StatusConflict, CodeDownloadPending, "Finish a download on this session first")
+		return
+	}
+
+	sizeMB := int(fileSize / (1024 * 1024))
+	resp := NextSizeResponse{
+		SessionID:         sessionID,
+		SizeMB:            sizeMB,
+		DownloadSpeedMbps: speedMbps,
+		NextSizeMB:        nextSizeMB(sizeMB, speedMbps),
+	}
+	resp.Converged = resp.NextSizeMB == sizeMB
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// nextSizeMB is the smallest allowed size that takes at least warmupTargetSeconds at speedMbps,
+// but at most warmupMaxGrowth times currentMB. Sizes grow exponentially until the target is
+// reached, and shrink straight away when the link is slower than expected.
+func nextSizeMB(currentMB int, speedMbps float64) int {
+	targetMB := speedMbps / 8 * warmupTargetSeconds
+	sizes := sortedSizesMB()
+	next := sizes[0]
+	for _, sizeMB := range sizes {
+		if sizeMB > currentMB*warmupMaxGrowth {
+			break
+		}
+		next = sizeMB
+		if float64(sizeMB) >= targetMB {
+			break
+		}
+	}
+	return next
+}
+
+// recommendedConnections suggests how many parallel connections a client should split a download of
+// size bytes across: one per bytesPerConnection, between 1 and MaxConnections. Timed streams run
+// long enough to ramp up whatever their number, so they get the maximum.
+func (h *DownloadHandler) recommendedConnections(size int64, timed bool) int {
+	if timed {
+		return h.cfg.MaxConnections
+	}
+	return int(max(1, min(int64(h.cfg.MaxConnections), size/bytesPerConnection)))
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// wsAcceptGUID is appended to the client's key to derive Sec-WebSocket-Accept (RFC 6455)
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// maxWSPingPayload is the largest frame /ping/ws echoes: anything that fits the 7-bit length,
+	// which is plenty for a timestamp
+	maxWSPingPayload = 125
+	// wsIdleTimeout closes a /ping/ws connection that hasn't sent a frame for this long
+	wsIdleTimeout = 30 * time.Second
+)
+
+// WebSocket opcodes
+const (
+	wsOpText   = 0x1
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xA
+)
+
+// WebSocket close codes
+const (
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+var errWSClosed = errors.New("closed by client")
+
+// PingWS upgrades to a WebSocket and echoes every text or binary frame straight back, so a client
+// can time many round trips over one connection without HTTP request overhead. Frames must be
+// unfragmented and at most 125 bytes. The echo loop reuses fixed buffers and doesn't allocate.
+// A delay_ms parameter delays every echo, as it does for /ping.
+func (h *DownloadHandler) PingWS(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		w.Header().Set("Upgrade", "websocket")
+		writeJSONError(w, http.StatusUpgradeRequired, CodeBadRequest, "/ping/ws needs a WebSocket upgrade")
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeJSONError(w, http.StatusUpgradeRequired, CodeBadRequest, "Only WebSocket version 13 is supported")
+		return
+	}
+	delay := h.responseDelay(r)
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 connections can't be taken over
+		writeJSONError(w, http.StatusHTTPVersionNotSupported, CodeUnsupported, "/ping/ws needs HTTP/1.1")
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{}) // Drop any deadline the server set for the HTTP request
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	rw.WriteString(wsAcceptKey(key))
+	rw.WriteString("\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	if err := echoWSFrames(conn, rw, delay); err != nil && !errors.Is(err, errWSClosed) && !errors.Is(err, io.EOF) {
+		log.Printf("WebSocket ping from %s ended: %v", getClientIP(r), err)
+	}
+}
+
+// echoWSFrames runs the echo loop of PingWS until the client closes, goes idle or breaks the
+// protocol
+func echoWSFrames(conn net.Conn, rw *bufio.ReadWriter, delay time.Duration) error {
+	var header [2]byte
+	var mask [4]byte
+	var payload [maxWSPingPayload]byte
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		if _, err := io.ReadFull(rw, header[:]); err != nil {
+			return err
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0F
+		masked, n := header[1]&0x80 != 0, int(header[1]&0x7F)
+		if !masked || !fin {
+			// Client frames must be masked; fragments would need reassembly, which a ping never does
+			closeWS(rw, wsCloseProtocolError)
+			return errors.New("unmasked or fragmented frame")
+		}
+		if n > maxWSPingPayload {
+			closeWS(rw, wsCloseTooBig)
+			return errors.New("frame too large")
+		}
+		if _, err := io.ReadFull(rw, mask[:]); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, payload[:n]); err != nil {
+			return err
+		}
+		for i := range n {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsOpText, wsOpBinary:
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+			writeWSFrame(rw.Writer, opcode, payload[:n])
+		case wsOpPing:
+			writeWSFrame(rw.Writer, wsOpPong, payload[:n])
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			writeWSFrame(rw.Writer, wsOpClose, payload[:min(n, 2)]) // Echo the status code
+			rw.Flush()
+			return errWSClosed
+		default:
+			closeWS(rw, wsCloseProtocolError)
+			return errors.New("unknown opcode")
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// writeWSFrame buffers a single unmasked server frame; payload must be at most 125 bytes
+func writeWSFrame(w *bufio.Writer, opcode byte, payload []byte) {
+	w.WriteByte(0x80 | opcode)
+	w.WriteByte(byte(len(payload)))
+	w.Write(payload)
+}
+
+// closeWS sends a close frame with the given status code
+func closeWS(rw *bufio.ReadWriter, code uint16) {
+	var status [2]byte
+	binary.BigEndian.PutUint16(status[:], code)
+	writeWSFrame(rw.Writer, wsOpClose, status[:])
+	rw.Flush()
+}
+
+// wsAcceptKey derives the Sec-WebSocket-Accept value for a client's Sec-WebSocket-Key
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma-separated header, such as Connection, lists token
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
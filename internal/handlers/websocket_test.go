@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+)
+
+// BenchmarkEcho times one round trip of a 19-byte frame through echoWSFrames over loopback TCP
+func BenchmarkEcho(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		echoWSFrames(conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), 0)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	payload := []byte("1712345678901234567")
+	mask := [4]byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | wsOpText, 0x80 | byte(len(payload))}, mask[:]...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	reply := make([]byte, 2+len(payload))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(frame); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if string(reply[2:]) != string(payload) {
+		b.Fatalf("echoed %q, want %q", reply[2:], payload)
+	}
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+)
+
+type WhoAmIResponse struct {
+	ClientIP   string `json:"client_ip"`
+	Proto      string `json:"proto"`
+	TLSVersion string `json:"tls_version,omitempty"`
+	TLSCipher  string `json:"tls_cipher,omitempty"`
+}
+
+// WhoAmI reports how the server sees the client's connection: the detected IP, the HTTP protocol
+// and, for HTTPS, the negotiated TLS version and cipher suite
+func (h *DownloadHandler) WhoAmI(w http.ResponseWriter, r *http.Request) {
+	resp := WhoAmIResponse{
+		ClientIP: getClientIP(r),
+		Proto:    r.Proto,
+	}
+	if r.TLS != nil {
+		resp.TLSVersion = tls.VersionName(r.TLS.Version)
+		resp.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,4 @@
+// Package rpcpb holds the generated gRPC code for speedtest.proto
+package rpcpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative speedtest.proto
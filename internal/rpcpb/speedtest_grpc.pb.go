@@ -0,0 +1,253 @@
+// gRPC interface to the speed test, served with -grpc-addr. Every call is a request to the REST API
+// made in-process, so the two share sessions, validation and limits. Errors carry the REST error
+// code in the status message, as "CODE: message".
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: speedtest.proto
+
+package rpcpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	SpeedTest_Init_FullMethodName     = "/speedtest.v1.SpeedTest/Init"
+	SpeedTest_Download_FullMethodName = "/speedtest.v1.SpeedTest/Download"
+	SpeedTest_Verify_FullMethodName   = "/speedtest.v1.SpeedTest/Verify"
+	SpeedTest_Speed_FullMethodName    = "/speedtest.v1.SpeedTest/Speed"
+)
+
+// SpeedTestClient is the client API for SpeedTest service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SpeedTestClient interface {
+	// Init creates a session, like POST /download/init
+	Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error)
+	// Download streams a session's file, like GET /download/data. The whole stream is one timed
+	// download, so Speed afterwards reports it as it would an HTTP download.
+	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadChunk], error)
+	// Verify checks the client's hash, like POST /download/verify
+	Verify(ctx context.Context, in *VerifyRequest, opts ...grpc.CallOption) (*VerifyResponse, error)
+	// Speed reports the measured speed, like GET /download/speed
+	Speed(ctx context.Context, in *SpeedRequest, opts ...grpc.CallOption) (*SpeedResponse, error)
+}
+
+type speedTestClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSpeedTestClient(cc grpc.ClientConnInterface) SpeedTestClient {
+	return &speedTestClient{cc}
+}
+
+func (c *speedTestClient) Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(InitResponse)
+	err := c.cc.Invoke(ctx, SpeedTest_Init_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *speedTestClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &SpeedTest_ServiceDesc.Streams[0], SpeedTest_Download_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DownloadRequest, DownloadChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SpeedTest_DownloadClient = grpc.ServerStreamingClient[DownloadChunk]
+
+func (c *speedTestClient) Verify(ctx context.Context, in *VerifyRequest, opts ...grpc.CallOption) (*VerifyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VerifyResponse)
+	err := c.cc.Invoke(ctx, SpeedTest_Verify_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *speedTestClient) Speed(ctx context.Context, in *SpeedRequest, opts ...grpc.CallOption) (*SpeedResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SpeedResponse)
+	err := c.cc.Invoke(ctx, SpeedTest_Speed_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SpeedTestServer is the server API for SpeedTest service.
+// All implementations must embed UnimplementedSpeedTestServer
+// for forward compatibility.
+type SpeedTestServer interface {
+	// Init creates a session, like POST /download/init
+	Init(context.Context, *InitRequest) (*InitResponse, error)
+	// Download streams a session's file, like GET /download/data. The whole stream is one timed
+	// download, so Speed afterwards reports it as it would an HTTP download.
+	Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadChunk]) error
+	// Verify checks the client's hash, like POST /download/verify
+	Verify(context.Context, *VerifyRequest) (*VerifyResponse, error)
+	// Speed reports the measured speed, like GET /download/speed
+	Speed(context.Context, *SpeedRequest) (*SpeedResponse, error)
+	mustEmbedUnimplementedSpeedTestServer()
+}
+
+// UnimplementedSpeedTestServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSpeedTestServer struct{}
+
+func (UnimplementedSpeedTestServer) Init(context.Context, *InitRequest) (*InitResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Init not implemented")
+}
+func (UnimplementedSpeedTestServer) Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedSpeedTestServer) Verify(context.Context, *VerifyRequest) (*VerifyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Verify not implemented")
+}
+func (UnimplementedSpeedTestServer) Speed(context.Context, *SpeedRequest) (*SpeedResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Speed not implemented")
+}
+func (UnimplementedSpeedTestServer) mustEmbedUnimplementedSpeedTestServer() {}
+func (UnimplementedSpeedTestServer) testEmbeddedByValue()                   {}
+
+// UnsafeSpeedTestServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SpeedTestServer will
+// result in compilation errors.
+type UnsafeSpeedTestServer interface {
+	mustEmbedUnimplementedSpeedTestServer()
+}
+
+func RegisterSpeedTestServer(s grpc.ServiceRegistrar, srv SpeedTestServer) {
+	// If the following call pancis, it indicates UnimplementedSpeedTestServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&SpeedTest_ServiceDesc, srv)
+}
+
+func _SpeedTest_Init_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpeedTestServer).Init(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SpeedTest_Init_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpeedTestServer).Init(ctx, req.(*InitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SpeedTest_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SpeedTestServer).Download(m, &grpc.GenericServerStream[DownloadRequest, DownloadChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type SpeedTest_DownloadServer = grpc.ServerStreamingServer[DownloadChunk]
+
+func _SpeedTest_Verify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpeedTestServer).Verify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SpeedTest_Verify_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpeedTestServer).Verify(ctx, req.(*VerifyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SpeedTest_Speed_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SpeedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpeedTestServer).Speed(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SpeedTest_Speed_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpeedTestServer).Speed(ctx, req.(*SpeedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SpeedTest_ServiceDesc is the grpc.ServiceDesc for SpeedTest service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SpeedTest_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "speedtest.v1.SpeedTest",
+	HandlerType: (*SpeedTestServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Init",
+			Handler:    _SpeedTest_Init_Handler,
+		},
+		{
+			MethodName: "Verify",
+			Handler:    _SpeedTest_Verify_Handler,
+		},
+		{
+			MethodName: "Speed",
+			Handler:    _SpeedTest_Speed_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Download",
+			Handler:       _SpeedTest_Download_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "speedtest.proto",
+}